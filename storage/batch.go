@@ -0,0 +1,41 @@
+package storage
+
+// WriteBatch collects puts and deletes to be applied to a
+// tree atomically, with LSMTree.Write.
+//
+// The writes are applied in the order they were added, so a
+// later write to the same key wins.
+type WriteBatch struct {
+	records []Record
+}
+
+// NewWriteBatch creates a new, empty write batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds a put of the value v for the key k to the batch.
+func (b *WriteBatch) Put(k string, v map[string]any) {
+	b.records = append(b.records, Record{
+		Key:   k,
+		Value: v,
+	})
+}
+
+// Del adds a delete of the key k to the batch.
+func (b *WriteBatch) Del(k string) {
+	b.records = append(b.records, Record{
+		Key:  k,
+		Tomb: true,
+	})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Reset clears the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.records = b.records[:0]
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestLSMTree_Write(t *testing.T) {
+	t.Run("should apply a batch atomically", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		before := tree.Snapshot()
+		defer before.Release()
+
+		b := NewWriteBatch()
+		b.Put("a", map[string]any{"v": 2.0})
+		b.Put("b", map[string]any{"v": 2.0})
+		b.Del("a")
+		b.Put("c", map[string]any{"v": 2.0})
+		if err := tree.Write(b); err != nil {
+			t.Fatalf("failed to write batch: %s", err)
+		}
+
+		// The snapshot from before shouldn't see any of it
+		if v, err := before.Get("a"); err != nil || v["v"] != 1.0 {
+			t.Fatalf("expected key %q to have v=1, got %v (err=%v)", "a", v, err)
+		}
+		if v, err := before.Get("b"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be missing, got %v (err=%v)", "b", v, err)
+		}
+
+		// ...and the tree should see all of it, in order
+		if v, err := tree.Get("a"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be deleted, got %v (err=%v)", "a", v, err)
+		}
+		for _, k := range []string{"b", "c"} {
+			if v, err := tree.Get(k); err != nil || v["v"] != 2.0 {
+				t.Fatalf("expected key %q to have v=2, got %v (err=%v)", k, v, err)
+			}
+		}
+	})
+
+	t.Run("should recover all or none of a batch", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "wal")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		w, err := CreateWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to create wal: %s", err)
+		}
+		m := NewMemtable(w, nil)
+		b := NewWriteBatch()
+		b.Put("a", map[string]any{})
+		b.Put("b", map[string]any{})
+		if err := m.Write(b); err != nil {
+			t.Fatalf("failed to write batch: %s", err)
+		}
+		b.Reset()
+		b.Put("c", map[string]any{})
+		b.Put("d", map[string]any{})
+		if err := m.Write(b); err != nil {
+			t.Fatalf("failed to write batch: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close wal: %s", err)
+		}
+
+		// Tear the second batch
+		p := fmtWALPath(d, 1)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("failed to stat wal: %s", err)
+		}
+		if err := os.Truncate(p, fi.Size()-1); err != nil {
+			t.Fatalf("failed to truncate wal: %s", err)
+		}
+
+		w, err = OpenWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to open wal: %s", err)
+		}
+		defer w.Close()
+		m, err = LoadMemtable(w, nil)
+		if err != nil {
+			t.Fatalf("failed to load memtable: %s", err)
+		}
+		for k, expected := range map[string]bool{"a": true, "b": true, "c": false, "d": false} {
+			r, _ := m.Get(k)
+			if (r != nil) != expected {
+				t.Fatalf("expected key %q found=%t, got %+v", k, expected, r)
+			}
+		}
+		if seq := m.LastSeq(); seq != 2 {
+			t.Fatalf("expected last seq 2, got %d", seq)
+		}
+	})
+	t.Run("should reject a batch with an empty key", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		b := NewWriteBatch()
+		b.Put("a", map[string]any{"v": 1.0})
+		b.Del("")
+		if err := tree.Write(b); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey, got %v", err)
+		}
+
+		// None of the batch should have been written
+		if v, err := tree.Get("a"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be missing, got %v (err=%v)", "a", v, err)
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// DefaultBlockSize is the default target size, in bytes,
+// of an SSTable data block.
+const DefaultBlockSize = 4 << 10
+
+// SSTable data file format
+//
+// A data file is a sequence of data blocks, followed by an
+// index block and a fixed-size footer:
+//
+//	+----------------+-----+----------------+-------------+--------+
+//	| data block 0   | ... | data block n   | index block | footer |
+//	+----------------+-----+----------------+-------------+--------+
+//
+// A data block is a sequence of records, in key order (in the
+// binary record encoding -- see appendRecord), each prefixed with
+// its uvarint-encoded length:
+//
+//	+--------------+---------------+--------------+-----
+//	| len (uvarint)| record (len)  | len (uvarint)| ...
+//	+--------------+---------------+--------------+-----
+//
+// Each data block is compressed on its own, with the compressor
+// named in the table's metadata (see Compressor), so a lookup only
+// has to decompress the one block it reads. The compressed block
+// is followed by a CRC32C checksum of it (u32, little-endian),
+// which is verified whenever the block is read.
+//
+// The index block holds the table's record count and last key,
+// followed by a handle for each data block (the block's first
+// key, offset and size), so a point lookup can binary search
+// the index and then read and decode a single block:
+//
+//	count (uvarint) | len(lastKey) (uvarint) | lastKey |
+//	nBlocks (uvarint) | { len(key) | key | offset | size }...
+//
+// Like the data blocks, it's followed by a CRC32C checksum. The
+// block sizes in the handles and footer don't include checksums.
+//
+// The footer is fixed-size (little-endian) and points to the
+// index block:
+//
+//	+---------------------+-------------------+---------------+-------------+
+//	| index offset (u64)  | index size (u64)  | version (u32) | magic (u32) |
+//	+---------------------+-------------------+---------------+-------------+
+//
+// Older tables are still read as they are. Version 1 tables,
+// written before checksums were added, have no checksums after
+// their blocks (or bloom filter files), and version 1 and 2 tables
+// have JSON-encoded records.
+const (
+	sstFormatVersion   = 3
+	sstChecksumVersion = 2          // The first format version with checksums
+	sstBinaryVersion   = 3          // The first format version with binary-encoded records
+	sstMagic           = 0x65756c62 // "blue"
+	sstFooterSize      = 8 + 8 + 4 + 4
+)
+
+// blockHandle points to a data block in an SSTable's data file.
+type blockHandle struct {
+	firstKey string // The first key in the block
+	offset   uint64 // The block's offset in the data file
+	size     uint64 // The block's size, in bytes
+}
+
+// blockBuilder accumulates encoded records for a data block.
+type blockBuilder struct {
+	buf      []byte
+	firstKey string
+}
+
+// add appends the record to the block.
+func (bb *blockBuilder) add(r Record) error {
+	b, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+	if len(bb.buf) == 0 {
+		bb.firstKey = r.Key
+	}
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(len(b)))
+	bb.buf = append(bb.buf, b...)
+	return nil
+}
+
+// empty returns true if no records have been added to the block.
+func (bb *blockBuilder) empty() bool {
+	return len(bb.buf) == 0
+}
+
+// reset clears the block so it can be reused.
+func (bb *blockBuilder) reset() {
+	bb.buf = bb.buf[:0]
+	bb.firstKey = ""
+}
+
+// decodeBlock decodes the records in a data block. If legacy
+// is true, the records are JSON-encoded (as in tables written
+// before version 3 of the format).
+func decodeBlock(b []byte, legacy bool) ([]Record, error) {
+	var records []Record
+	for len(b) > 0 {
+		n, w := binary.Uvarint(b)
+		if w <= 0 || uint64(len(b)-w) < n {
+			return nil, fmt.Errorf("malformed block entry")
+		}
+		b = b[w:]
+
+		var r Record
+		var err error
+		if legacy {
+			err = json.Unmarshal(b[:n], &r)
+		} else {
+			r, err = unmarshalRecord(b[:n])
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+		b = b[n:]
+	}
+	return records, nil
+}
+
+// searchBlock returns the index of the first record in
+// the (sorted) block with a key >= k.
+func searchBlock(records []Record, k string) int {
+	return sort.Search(len(records), func(i int) bool {
+		return records[i].Key >= k
+	})
+}
+
+// sstIndex is a table's decoded index block.
+type sstIndex struct {
+	count   uint64        // The number of records in the table
+	lastKey string        // The last key in the table
+	blocks  []blockHandle // Handles to the data blocks, in order
+}
+
+// encodeIndex encodes the index block.
+func encodeIndex(idx sstIndex) []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, idx.count)
+	b = binary.AppendUvarint(b, uint64(len(idx.lastKey)))
+	b = append(b, idx.lastKey...)
+	b = binary.AppendUvarint(b, uint64(len(idx.blocks)))
+	for _, h := range idx.blocks {
+		b = binary.AppendUvarint(b, uint64(len(h.firstKey)))
+		b = append(b, h.firstKey...)
+		b = binary.AppendUvarint(b, h.offset)
+		b = binary.AppendUvarint(b, h.size)
+	}
+	return b
+}
+
+// decodeIndex decodes an index block.
+func decodeIndex(b []byte) (sstIndex, error) {
+	d := &decoder{b: b}
+	var idx sstIndex
+	idx.count = d.uvarint()
+	idx.lastKey = d.string()
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(b)) {
+		return sstIndex{}, fmt.Errorf("malformed index block")
+	}
+	idx.blocks = make([]blockHandle, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		var h blockHandle
+		h.firstKey = d.string()
+		h.offset = d.uvarint()
+		h.size = d.uvarint()
+		idx.blocks = append(idx.blocks, h)
+	}
+	if d.err != nil {
+		return sstIndex{}, fmt.Errorf("malformed index block: %w", d.err)
+	}
+	return idx, nil
+}
+
+// find returns the position of the block that could contain
+// the key k, or -1 if k comes before the first block.
+func (idx sstIndex) find(k string) int {
+	i := sort.Search(len(idx.blocks), func(i int) bool {
+		return idx.blocks[i].firstKey > k
+	})
+	return i - 1
+}
+
+// sstFooter is the fixed-size trailer of a data file.
+type sstFooter struct {
+	indexOffset uint64
+	indexSize   uint64
+	version     uint32
+}
+
+// checksummed returns true if the table's blocks (and bloom
+// filter files) have checksums.
+func (f sstFooter) checksummed() bool {
+	return f.version >= sstChecksumVersion
+}
+
+// legacyRecords returns true if the table's records are
+// JSON-encoded.
+func (f sstFooter) legacyRecords() bool {
+	return f.version < sstBinaryVersion
+}
+
+func encodeFooter(f sstFooter) []byte {
+	b := make([]byte, sstFooterSize)
+	binary.LittleEndian.PutUint64(b[0:8], f.indexOffset)
+	binary.LittleEndian.PutUint64(b[8:16], f.indexSize)
+	binary.LittleEndian.PutUint32(b[16:20], f.version)
+	binary.LittleEndian.PutUint32(b[20:24], sstMagic)
+	return b
+}
+
+func decodeFooter(b []byte) (sstFooter, error) {
+	if len(b) != sstFooterSize {
+		return sstFooter{}, fmt.Errorf("footer is %d bytes, expected %d", len(b), sstFooterSize)
+	}
+	if m := binary.LittleEndian.Uint32(b[20:24]); m != sstMagic {
+		return sstFooter{}, fmt.Errorf("bad magic number %#x", m)
+	}
+	f := sstFooter{
+		indexOffset: binary.LittleEndian.Uint64(b[0:8]),
+		indexSize:   binary.LittleEndian.Uint64(b[8:16]),
+		version:     binary.LittleEndian.Uint32(b[16:20]),
+	}
+	if f.version < 1 || f.version > sstFormatVersion {
+		return sstFooter{}, fmt.Errorf("unsupported format version %d", f.version)
+	}
+	return f, nil
+}
+
+// decoder reads uvarints and length-prefixed strings from a
+// byte slice, remembering the first error it hits.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, w := binary.Uvarint(d.b)
+	if w <= 0 {
+		d.err = fmt.Errorf("bad uvarint")
+		return 0
+	}
+	d.b = d.b[w:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = fmt.Errorf("string length %d exceeds remaining %d bytes", n, len(d.b))
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBlockCacheSize is the default capacity, in bytes, of
+// a tree's block cache.
+const DefaultBlockCacheSize = 8 << 20
+
+// blockCacheShards is the number of independently locked shards
+// in a block cache, so concurrent reads don't all contend on
+// one lock.
+const blockCacheShards = 16
+
+// BlockCache is a size-bounded LRU cache of decoded SSTable data
+// blocks, shared by all the tables in a tree.
+//
+// Blocks are keyed by their table's id and their offset in the
+// table's data file, and charged by their decompressed size. The
+// cache is split into shards, each with its own lock and an equal
+// share of the capacity, and each evicting its least recently
+// used blocks once it's over its share.
+//
+// The cached records are shared between readers, so they must
+// not be modified.
+type BlockCache struct {
+	shards [blockCacheShards]cacheShard
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// BlockCacheStats are a snapshot of a block cache's counters.
+type BlockCacheStats struct {
+	Hits   uint64 // Number of lookups that found their block
+	Misses uint64 // Number of lookups that didn't
+	Size   uint64 // Total size of the cached blocks, in bytes
+	Blocks int    // Number of cached blocks
+}
+
+// blockKey identifies a block in a block cache.
+type blockKey struct {
+	table  string // The table's id
+	offset uint64 // The block's offset in the table's data file
+}
+
+// cacheEntry is a cached block.
+type cacheEntry struct {
+	key     blockKey
+	records []Record
+	size    uint64
+}
+
+type cacheShard struct {
+	sync.Mutex
+	capacity uint64
+	size     uint64
+	items    map[blockKey]*list.Element
+	lru      *list.List // Most recently used at the front
+}
+
+// NewBlockCache creates an empty block cache that holds up to
+// capacity bytes of blocks.
+func NewBlockCache(capacity uint64) *BlockCache {
+	c := &BlockCache{}
+	for i := range c.shards {
+		c.shards[i] = cacheShard{
+			capacity: max(capacity/blockCacheShards, 1),
+			items:    make(map[blockKey]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+// Stats returns the cache's hit and miss counts, and its
+// current size.
+func (c *BlockCache) Stats() BlockCacheStats {
+	s := BlockCacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+	}
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.Lock()
+		s.Size += sh.size
+		s.Blocks += len(sh.items)
+		sh.Unlock()
+	}
+	return s
+}
+
+func (c *BlockCache) shard(k blockKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(k.table))
+	return &c.shards[(h.Sum32()^uint32(k.offset))%blockCacheShards]
+}
+
+// get returns the cached block's records, if it's in the cache,
+// and marks it as recently used.
+func (c *BlockCache) get(k blockKey) ([]Record, bool) {
+	sh := c.shard(k)
+	sh.Lock()
+	defer sh.Unlock()
+
+	el, ok := sh.items[k]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	sh.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).records, true
+}
+
+// put adds the block's records to the cache, charging size bytes
+// for them, and evicts the least recently used blocks if the shard
+// is over capacity. Blocks bigger than the shard aren't cached.
+func (c *BlockCache) put(k blockKey, records []Record, size uint64) {
+	sh := c.shard(k)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if size > sh.capacity {
+		return
+	}
+	if el, ok := sh.items[k]; ok {
+		sh.lru.MoveToFront(el)
+		return
+	}
+	sh.items[k] = sh.lru.PushFront(&cacheEntry{key: k, records: records, size: size})
+	sh.size += size
+	for sh.size > sh.capacity {
+		sh.remove(sh.lru.Back())
+	}
+}
+
+// evictTable removes all of the table's blocks from the cache.
+func (c *BlockCache) evictTable(id string) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.Lock()
+		for k, el := range sh.items {
+			if k.table == id {
+				sh.remove(el)
+			}
+		}
+		sh.Unlock()
+	}
+}
+
+func (sh *cacheShard) remove(el *list.Element) {
+	e := sh.lru.Remove(el).(*cacheEntry)
+	delete(sh.items, e.key)
+	sh.size -= e.size
+}
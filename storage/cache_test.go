@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	t.Run("should evict the least recently used blocks", func(t *testing.T) {
+		// Each shard holds two 10-byte blocks
+		c := NewBlockCache(20 * blockCacheShards)
+		records := []Record{{Key: "a"}}
+
+		// Find three keys in the same shard
+		var keys []blockKey
+		for i := uint64(0); len(keys) < 3; i++ {
+			k := blockKey{table: "t", offset: i}
+			if len(keys) == 0 || c.shard(k) == c.shard(keys[0]) {
+				keys = append(keys, k)
+			}
+		}
+
+		c.put(keys[0], records, 10)
+		c.put(keys[1], records, 10)
+		if _, ok := c.get(keys[0]); !ok {
+			t.Fatalf("expected block to be cached")
+		}
+
+		// Adding a third should evict the second (the first was used more recently)
+		c.put(keys[2], records, 10)
+		if _, ok := c.get(keys[1]); ok {
+			t.Fatalf("expected the least recently used block to be evicted")
+		}
+		for _, k := range []blockKey{keys[0], keys[2]} {
+			if _, ok := c.get(k); !ok {
+				t.Fatalf("expected block %+v to be cached", k)
+			}
+		}
+
+		stats := c.Stats()
+		if stats.Hits != 3 || stats.Misses != 1 || stats.Size != 20 || stats.Blocks != 2 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("should be shared by a tree's tables and evict deleted ones", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		for i := 0; i < 10; i++ {
+			k := fmt.Sprintf("key-%02d", i)
+			if err := tree.Put(k, map[string]any{"i": float64(i)}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		flushTestTree(t, tree)
+
+		// The first read misses, the second hits
+		for i := 0; i < 2; i++ {
+			if v, err := tree.Get("key-05"); err != nil || v["i"] != 5.0 {
+				t.Fatalf("expected i=5, got %v (err=%v)", v, err)
+			}
+		}
+		stats := tree.BlockCacheStats()
+		if stats.Hits != 1 || stats.Misses != 1 || stats.Blocks != 1 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+
+		// Compacting the table away should evict its blocks
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if stats := tree.BlockCacheStats(); stats.Blocks != 0 {
+			t.Fatalf("expected the deleted table's blocks to be evicted, got %+v", stats)
+		}
+	})
+
+	t.Run("should not let callers modify cached values", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"n": 1, "l": []any{"x"}}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+
+		// Modify each of the values read back...
+		v, err := tree.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		v["n"] = 2
+		v["l"].([]any)[0] = "y"
+		it := tree.Scan("", "")
+		for it.Next() {
+			it.Value()["n"] = 3
+		}
+		if err := it.Close(); err != nil {
+			t.Fatalf("failed to close iterator: %s", err)
+		}
+		r, err := tree.levels[0].Get("a")
+		if err != nil || r == nil {
+			t.Fatalf("failed to get from level: %v (err=%v)", r, err)
+		}
+		r.Value["n"] = 4
+		r.Value["l"].([]any)[0] = "z"
+
+		// ...and make sure the cached block wasn't changed
+		v, err = tree.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if v["n"] != int64(1) || v["l"].([]any)[0] != "x" {
+			t.Fatalf("expected the stored value to be unchanged, got %v", v)
+		}
+		if stats := tree.BlockCacheStats(); stats.Hits == 0 {
+			t.Fatalf("expected the reads to hit the cache, got %+v", stats)
+		}
+	})
+}
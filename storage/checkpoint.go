@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Checkpoint writes a consistent copy of the tree to the directory
+// dir, which can be opened with LoadLSMTree as an independent tree.
+// The directory must not already exist.
+//
+// Writes are only blocked while the memtables' WALs are copied.
+// The tables are pinned (like a Snapshot's), so compaction can't
+// delete them while they're being checkpointed, and since they're
+// never modified once written, they're hard-linked into the
+// checkpoint rather than copied -- unless dir is on a different
+// filesystem, in which case they're copied too.
+func (t *LSMTree) Checkpoint(dir string) (err error) {
+	// Make sure there isn't anything there already
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("checkpoint directory %q already exists", dir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// Create the directories, and clean them up if anything fails
+	wd, ld := path.Join(dir, WALDirName), path.Join(dir, LevelsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	for _, d := range []string{wd, ld} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return fmt.Errorf("failed to create checkpoint directory: %w", err)
+		}
+	}
+
+	// Lock out writers while the tables are pinned and the WALs are
+	// copied, so the WALs hold exactly the writes the tables don't
+	// (compaction swaps tables under the same lock, so the levels
+	// are consistent too)
+	t.Lock()
+	meta, seq, flushed := t.meta, t.seq.Load(), t.flushedSeq
+	levels := make([][]*SSTable, len(t.levels))
+	for i, level := range t.levels {
+		levels[i] = level.pin()
+	}
+	defer func() {
+		for _, tables := range levels {
+			for _, table := range tables {
+				if err2 := table.unref(); err2 != nil && err == nil {
+					err = err2
+				}
+			}
+		}
+	}()
+	for _, m := range []*Memtable{t.frozenMemtable, t.memtable} {
+		if m == nil || m.wal == nil {
+			continue
+		}
+		if err := copyFile(m.wal.path, path.Join(wd, path.Base(m.wal.path))); err != nil {
+			t.Unlock()
+			return fmt.Errorf("failed to copy wal id=%d: %w", m.wal.ID(), err)
+		}
+	}
+	t.Unlock()
+
+	// Link the tables into each level
+	v := &version{levels: make([][]string, len(levels)), lastSeq: seq, flushedSeq: flushed}
+	for i, tables := range levels {
+		n := uint16(i + 1)
+		src, dst := fmtLevelPath(t.levelDir(), n), fmtLevelPath(ld, n)
+		if err := os.Mkdir(dst, 0755); err != nil {
+			return fmt.Errorf("failed to create checkpoint level %d: %w", n, err)
+		}
+		if err := copyFile(path.Join(src, LevelMetaFileName), path.Join(dst, LevelMetaFileName)); err != nil {
+			return fmt.Errorf("failed to copy level %d meta file: %w", n, err)
+		}
+		for _, table := range tables {
+			if err := linkTable(src, dst, table.id); err != nil {
+				return fmt.Errorf("failed to link sst id=%q: %w", table.id, err)
+			}
+		}
+		if err := syncDir(dst); err != nil {
+			return err
+		}
+		v.levels[i] = ids(tables)
+	}
+
+	// Write the manifest, with the pinned tables (which the levels'
+	// metadata may not match, if a compaction was running)
+	m, err := createManifest(dir, v)
+	if err != nil {
+		return err
+	}
+	if err := m.Close(); err != nil {
+		return err
+	}
+
+	// Write the tree's metadata last, so a half-written
+	// checkpoint isn't mistaken for a real tree
+	meta.Levels = uint16(len(levels))
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tree metadata: %w", err)
+	}
+	if err := writeFileAtomic(path.Join(dir, TreeMetaFileName), b); err != nil {
+		return fmt.Errorf("failed to write tree metadata to file: %w", err)
+	}
+	for _, d := range []string{wd, ld} {
+		if err := syncDir(d); err != nil {
+			return err
+		}
+	}
+
+	// Done
+	return nil
+}
+
+// linkTable hard-links the files of the table with the given id
+// from the level directory src into the level directory dst,
+// falling back to copying them if they can't be linked.
+func linkTable(src, dst, id string) error {
+	sd, dd := path.Join(src, id), path.Join(dst, id)
+	ents, err := os.ReadDir(sd)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dd, 0755); err != nil {
+		return err
+	}
+	for _, e := range ents {
+		sp, dp := path.Join(sd, e.Name()), path.Join(dd, e.Name())
+		if err := os.Link(sp, dp); err != nil {
+			if err := copyFile(sp, dp); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(dd)
+}
+
+// copyFile copies the file at src to a new file at dst, and
+// syncs it to disk.
+func copyFile(src, dst string) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		return err
+	}
+	if err := df.Sync(); err != nil {
+		df.Close()
+		return err
+	}
+	return df.Close()
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLSMTree_Checkpoint(t *testing.T) {
+	t.Run("should open a checkpoint as an independent tree", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+
+		// Spread the data across a level compaction, a flush and the memtable
+		for _, k := range []string{"a", "b"} {
+			if err := tree.Put(k, map[string]any{"k": k}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		flushTestTree(t, tree)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if err := tree.Put("c", map[string]any{"k": "c"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.Put("d", map[string]any{"k": "d"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+
+		d, err := os.MkdirTemp("", "checkpoint")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+		cp := path.Join(d, "cp")
+		if err := tree.Checkpoint(cp); err != nil {
+			t.Fatalf("failed to checkpoint: %s", err)
+		}
+
+		// The tables should be hard-linked, not copied
+		src := tree.levels[1].tables[0]
+		sfi, err := os.Stat(path.Join(src.path, src.id, SSTDataFileName))
+		if err != nil {
+			t.Fatalf("failed to stat table: %s", err)
+		}
+		dfi, err := os.Stat(path.Join(fmtLevelPath(path.Join(cp, LevelsDirName), 2), src.id, SSTDataFileName))
+		if err != nil {
+			t.Fatalf("failed to stat checkpointed table: %s", err)
+		}
+		if !os.SameFile(sfi, dfi) {
+			t.Fatalf("expected the checkpointed table to be a hard link")
+		}
+
+		// Writes after the checkpoint shouldn't show up in it...
+		if err := tree.Put("e", map[string]any{"k": "e"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		cpTree, err := LoadLSMTree(LoadLSMTreeConf{Path: cp, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load checkpoint: %s", err)
+		}
+		defer cpTree.Close()
+		for k, expected := range map[string]any{"a": nil, "b": "b", "c": "c", "d": "d", "e": nil} {
+			v, err := cpTree.Get(k)
+			if err != nil {
+				t.Fatalf("failed to get: %s", err)
+			}
+			if (expected == nil && v != nil) || (expected != nil && v["k"] != expected) {
+				t.Fatalf("expected key %q to have k=%v in the checkpoint, got %v", k, expected, v)
+			}
+		}
+
+		// ...and writes to the checkpoint shouldn't show up in the tree
+		if err := cpTree.Put("f", map[string]any{"k": "f"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, cpTree)
+		if err := cpTree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact checkpoint: %s", err)
+		}
+		if v, err := tree.Get("f"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be missing from the tree, got %v (err=%v)", "f", v, err)
+		}
+		if v, err := tree.Get("b"); err != nil || v["k"] != "b" {
+			t.Fatalf("expected key %q in the tree after compacting the checkpoint, got %v (err=%v)", "b", v, err)
+		}
+	})
+
+	t.Run("should refuse to overwrite an existing directory", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		d, err := os.MkdirTemp("", "checkpoint")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+		if err := tree.Checkpoint(d); err == nil {
+			t.Fatalf("expected an error checkpointing into an existing directory")
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// checksumSize is the size of a CRC32C checksum trailer.
+const checksumSize = 4
+
+// crcTable is the CRC32C (Castagnoli) table used for checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruption is returned (wrapped in a *CorruptionError) when
+// data read back from disk fails its checksum or can't be decoded.
+var ErrCorruption = errors.New("corruption")
+
+// CorruptionError describes corrupt data found on disk, such as
+// an SSTable block or WAL frame that fails its checksum.
+//
+// It wraps ErrCorruption, so it can be checked for with errors.Is,
+// and the details can be read with errors.As.
+type CorruptionError struct {
+	Table  string // The id of the table (empty for WALs and the manifest)
+	File   string // The name of the corrupt file
+	Offset int64  // The offset of the corrupt data in the file
+	Reason string // What's wrong with it
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Table != "" {
+		return fmt.Sprintf("sst id=%q %s is corrupt at offset %d: %s", e.Table, e.File, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("%s is corrupt at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorruption
+}
+
+// appendChecksum appends a CRC32C checksum of b to b.
+func appendChecksum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// verifyChecksum checks the CRC32C checksum trailer at the end
+// of b, and returns the data before it.
+func verifyChecksum(b []byte) ([]byte, error) {
+	if len(b) < checksumSize {
+		return nil, fmt.Errorf("%d bytes is too short for a checksum", len(b))
+	}
+	n := len(b) - checksumSize
+	sum := binary.LittleEndian.Uint32(b[n:])
+	if crc := crc32.Checksum(b[:n], crcTable); crc != sum {
+		return nil, fmt.Errorf("checksum mismatch (got %#08x, expected %#08x)", crc, sum)
+	}
+	return b[:n], nil
+}
@@ -0,0 +1,459 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// Record encoding
+//
+// Records are stored in the WAL and in SSTable data blocks in a
+// compact binary format:
+//
+//	flags (u8) | len(key) (uvarint) | key | seq (uvarint) |
+//	[ expires (varint) ] | [ value ]
+//
+// Where the flags say whether the record is a tombstone or a
+// merge operand, and whether the expiry time and value are present.
+//
+// Values are self-describing -- each one starts with a type tag,
+// so the types of the values in a record's map are preserved:
+//
+//	nil, false, true  | tag only
+//	int               | tag | value (varint)
+//	uint              | tag | value (uvarint)
+//	float             | tag | IEEE 754 bits (u64, little-endian)
+//	string, bytes     | tag | len (uvarint) | data
+//	time              | tag | len (uvarint) | time.Time.MarshalBinary
+//	map               | tag | count (uvarint) | { len(key) | key | value }...
+//	list              | tag | count (uvarint) | { value }...
+//
+// All signed integer types decode as int64, all unsigned ones as
+// uint64 and both float types as float64. Maps with string keys
+// decode as map[string]any and other slices (and arrays) as []any.
+// Values of any other type (e.g. structs) are stored as the value
+// they'd unmarshal to from JSON, which is how they were stored
+// before this format.
+const (
+	recordFlagTomb    = 1 << iota // The record is a tombstone
+	recordFlagExpires             // The record has an expiry time
+	recordFlagValue               // The record has a value
+	recordFlagMerge               // The record is a merge operand
+)
+
+// Value type tags
+const (
+	valueNil byte = iota
+	valueFalse
+	valueTrue
+	valueInt
+	valueUint
+	valueFloat
+	valueString
+	valueBytes
+	valueTime
+	valueMap
+	valueList
+)
+
+// maxValueDepth is how deeply maps and lists can be nested.
+const maxValueDepth = 100
+
+// appendRecord appends the binary encoding of the record to b.
+func appendRecord(b []byte, r Record) ([]byte, error) {
+	var flags byte
+	if r.Tomb {
+		flags |= recordFlagTomb
+	}
+	if r.Expires != 0 {
+		flags |= recordFlagExpires
+	}
+	if r.Value != nil {
+		flags |= recordFlagValue
+	}
+	if r.Merge {
+		flags |= recordFlagMerge
+	}
+	b = append(b, flags)
+	b = appendString(b, r.Key)
+	b = binary.AppendUvarint(b, r.Seq)
+	if r.Expires != 0 {
+		b = binary.AppendVarint(b, r.Expires)
+	}
+	if r.Value != nil {
+		var err error
+		if b, err = appendValue(b, r.Value, 0); err != nil {
+			return nil, fmt.Errorf("failed to encode value of key %q: %w", r.Key, err)
+		}
+	}
+	return b, nil
+}
+
+// decodeRecord decodes the next record from d.
+func decodeRecord(d *decoder) (Record, error) {
+	flags := d.byte()
+	r := Record{
+		Key:   d.string(),
+		Seq:   d.uvarint(),
+		Tomb:  flags&recordFlagTomb != 0,
+		Merge: flags&recordFlagMerge != 0,
+	}
+	if flags&recordFlagExpires != 0 {
+		r.Expires = d.varint()
+	}
+	if flags&recordFlagValue != 0 {
+		v := d.value(0)
+		m, ok := v.(map[string]any)
+		if d.err == nil && !ok {
+			d.err = fmt.Errorf("record value is %T, not a map", v)
+		}
+		r.Value = m
+	}
+	if d.err != nil {
+		return Record{}, fmt.Errorf("malformed record: %w", d.err)
+	}
+	return r, nil
+}
+
+// encodeRecord returns the binary encoding of the record.
+func encodeRecord(r Record) ([]byte, error) {
+	return appendRecord(nil, r)
+}
+
+// unmarshalRecord decodes a binary-encoded record.
+func unmarshalRecord(b []byte) (Record, error) {
+	d := &decoder{b: b}
+	r, err := decodeRecord(d)
+	if err != nil {
+		return Record{}, err
+	}
+	if len(d.b) > 0 {
+		return Record{}, fmt.Errorf("malformed record: %d trailing bytes", len(d.b))
+	}
+	return r, nil
+}
+
+// normalizeRecord returns the record as it reads back once it's
+// been encoded and decoded, e.g. with its integers as int64s and
+// its lists as []any. If it can't be encoded, the record is
+// returned as is (and writing it will fail).
+func normalizeRecord(r Record) Record {
+	b, err := encodeRecord(r)
+	if err != nil {
+		return r
+	}
+	d, err := unmarshalRecord(b)
+	if err != nil {
+		return r
+	}
+	return d
+}
+
+// encodeRecords returns the binary encoding of a list of records
+// (e.g. a WAL batch), prefixed with the number of records.
+func encodeRecords(rs []Record) ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(rs)))
+	for _, r := range rs {
+		var err error
+		if b, err = appendRecord(b, r); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// unmarshalRecords decodes a list of records encoded by
+// encodeRecords.
+func unmarshalRecords(b []byte) ([]Record, error) {
+	d := &decoder{b: b}
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(b)) {
+		return nil, fmt.Errorf("malformed record list: %d records in %d bytes", n, len(b))
+	}
+	rs := make([]Record, 0, n)
+	for i := uint64(0); i < n; i++ {
+		r, err := decodeRecord(d)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("malformed record list: %w", d.err)
+	}
+	if len(d.b) > 0 {
+		return nil, fmt.Errorf("malformed record list: %d trailing bytes", len(d.b))
+	}
+	return rs, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendValue appends the tagged binary encoding of v to b.
+func appendValue(b []byte, v any, depth int) ([]byte, error) {
+	if depth > maxValueDepth {
+		return nil, fmt.Errorf("values are nested more than %d deep", maxValueDepth)
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return append(b, valueNil), nil
+	case bool:
+		if v {
+			return append(b, valueTrue), nil
+		}
+		return append(b, valueFalse), nil
+	case int:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int8:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int16:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int32:
+		return binary.AppendVarint(append(b, valueInt), int64(v)), nil
+	case int64:
+		return binary.AppendVarint(append(b, valueInt), v), nil
+	case uint:
+		return binary.AppendUvarint(append(b, valueUint), uint64(v)), nil
+	case uint8:
+		return binary.AppendUvarint(append(b, valueUint), uint64(v)), nil
+	case uint16:
+		return binary.AppendUvarint(append(b, valueUint), uint64(v)), nil
+	case uint32:
+		return binary.AppendUvarint(append(b, valueUint), uint64(v)), nil
+	case uint64:
+		return binary.AppendUvarint(append(b, valueUint), v), nil
+	case float32:
+		return binary.LittleEndian.AppendUint64(append(b, valueFloat), math.Float64bits(float64(v))), nil
+	case float64:
+		return binary.LittleEndian.AppendUint64(append(b, valueFloat), math.Float64bits(v)), nil
+	case string:
+		return appendString(append(b, valueString), v), nil
+	case []byte:
+		if v == nil {
+			return append(b, valueNil), nil
+		}
+		b = binary.AppendUvarint(append(b, valueBytes), uint64(len(v)))
+		return append(b, v...), nil
+	case time.Time:
+		tb, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b = binary.AppendUvarint(append(b, valueTime), uint64(len(tb)))
+		return append(b, tb...), nil
+	case map[string]any:
+		if v == nil {
+			return append(b, valueNil), nil
+		}
+		b = binary.AppendUvarint(append(b, valueMap), uint64(len(v)))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			var err error
+			b = appendString(b, k)
+			if b, err = appendValue(b, v[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case []any:
+		if v == nil {
+			return append(b, valueNil), nil
+		}
+		b = binary.AppendUvarint(append(b, valueList), uint64(len(v)))
+		for _, e := range v {
+			var err error
+			if b, err = appendValue(b, e, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return appendOtherValue(b, v, depth)
+}
+
+// appendOtherValue appends the encoding of a value that isn't
+// one of the types appendValue handles directly -- named basic
+// types are converted to their underlying types, other slices and
+// maps to []any and map[string]any, pointers are followed, and
+// anything else goes through JSON.
+func appendOtherValue(b []byte, v any, depth int) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return appendValue(b, rv.Bool(), depth)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendValue(b, rv.Int(), depth)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendValue(b, rv.Uint(), depth)
+	case reflect.Float32, reflect.Float64:
+		return appendValue(b, rv.Float(), depth)
+	case reflect.String:
+		return appendValue(b, rv.String(), depth)
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return append(b, valueNil), nil
+		}
+		return appendValue(b, rv.Elem().Interface(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return append(b, valueNil), nil
+		}
+		l := make([]any, rv.Len())
+		for i := range l {
+			l[i] = rv.Index(i).Interface()
+		}
+		return appendValue(b, l, depth)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			return append(b, valueNil), nil
+		}
+		m := make(map[string]any, rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			m[it.Key().String()] = it.Value().Interface()
+		}
+		return appendValue(b, m, depth)
+	}
+
+	// Fall back to JSON
+	jb, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %T value: %w", v, err)
+	}
+	var jv any
+	if err := json.Unmarshal(jb, &jv); err != nil {
+		return nil, fmt.Errorf("failed to encode %T value: %w", v, err)
+	}
+	return appendValue(b, jv, depth+1)
+}
+
+// The decoder's methods for the record encoding (the basic
+// ones are with the SSTable format, in block.go).
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) == 0 {
+		d.err = fmt.Errorf("unexpected end of data")
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, w := binary.Varint(d.b)
+	if w <= 0 {
+		d.err = fmt.Errorf("bad varint")
+		return 0
+	}
+	d.b = d.b[w:]
+	return v
+}
+
+// bytes returns the next n bytes (without copying them).
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.b)) < n {
+		d.err = fmt.Errorf("length %d exceeds remaining %d bytes", n, len(d.b))
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+// count reads a map or list's element count, checking that there
+// could be that many elements left (each takes at least a byte).
+func (d *decoder) count() uint64 {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.b)) {
+		d.err = fmt.Errorf("count %d exceeds remaining %d bytes", n, len(d.b))
+		return 0
+	}
+	return n
+}
+
+// value decodes the next tagged value.
+func (d *decoder) value(depth int) any {
+	if depth > maxValueDepth {
+		d.err = fmt.Errorf("values are nested more than %d deep", maxValueDepth)
+		return nil
+	}
+
+	switch tag := d.byte(); tag {
+	case valueNil:
+		return nil
+	case valueFalse:
+		return false
+	case valueTrue:
+		return true
+	case valueInt:
+		return d.varint()
+	case valueUint:
+		return d.uvarint()
+	case valueFloat:
+		b := d.bytes(8)
+		if d.err != nil {
+			return nil
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	case valueString:
+		return d.string()
+	case valueBytes:
+		return slices.Clone(d.bytes(d.uvarint()))
+	case valueTime:
+		b := d.bytes(d.uvarint())
+		if d.err != nil {
+			return nil
+		}
+		var t time.Time
+		if err := t.UnmarshalBinary(b); err != nil {
+			d.err = fmt.Errorf("bad time: %w", err)
+			return nil
+		}
+		return t
+	case valueMap:
+		n := d.count()
+		m := make(map[string]any, n)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			k := d.string()
+			m[k] = d.value(depth + 1)
+		}
+		return m
+	case valueList:
+		n := d.count()
+		l := make([]any, 0, n)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			l = append(l, d.value(depth+1))
+		}
+		return l
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unknown value type %d", tag)
+		}
+		return nil
+	}
+}
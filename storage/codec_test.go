@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordCodec(t *testing.T) {
+	t.Run("should round-trip typed values", func(t *testing.T) {
+		now := time.Now()
+		r := Record{
+			Key:     "a",
+			Seq:     42,
+			Expires: now.Add(time.Hour).UnixNano(),
+			Value: map[string]any{
+				"int":    int64(1<<53 + 1),
+				"neg":    int64(-7),
+				"uint":   uint64(1<<64 - 1),
+				"float":  3.14,
+				"bool":   true,
+				"string": "hello",
+				"bytes":  []byte{0, 1, 2},
+				"time":   now.Round(0),
+				"nil":    nil,
+				"map":    map[string]any{"nested": map[string]any{"x": false}},
+				"list":   []any{int64(1), "two", []any{3.0}},
+			},
+		}
+		b, err := encodeRecord(r)
+		if err != nil {
+			t.Fatalf("failed to encode record: %s", err)
+		}
+		got, err := unmarshalRecord(b)
+		if err != nil {
+			t.Fatalf("failed to decode record: %s", err)
+		}
+		if !reflect.DeepEqual(got, r) {
+			t.Fatalf("expected %+v, got %+v", r, got)
+		}
+	})
+
+	t.Run("should convert other types to the types they decode as", func(t *testing.T) {
+		type point struct {
+			X int `json:"x"`
+		}
+		type id int32
+		in := map[string]any{
+			"int":     7,
+			"uint8":   uint8(8),
+			"float32": float32(0.5),
+			"named":   id(9),
+			"strings": []string{"a", "b"},
+			"ints":    map[string]int{"a": 1},
+			"struct":  point{X: 1},
+			"pointer": &point{X: 2},
+		}
+		expected := map[string]any{
+			"int":     int64(7),
+			"uint8":   uint64(8),
+			"float32": 0.5,
+			"named":   int64(9),
+			"strings": []any{"a", "b"},
+			"ints":    map[string]any{"a": int64(1)},
+			"struct":  map[string]any{"x": 1.0},
+			"pointer": map[string]any{"x": 2.0},
+		}
+		b, err := encodeRecord(Record{Key: "a", Value: in})
+		if err != nil {
+			t.Fatalf("failed to encode record: %s", err)
+		}
+		got, err := unmarshalRecord(b)
+		if err != nil {
+			t.Fatalf("failed to decode record: %s", err)
+		}
+		if !reflect.DeepEqual(got.Value, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, got.Value)
+		}
+	})
+
+	t.Run("should reject malformed records", func(t *testing.T) {
+		b, err := encodeRecord(Record{Key: "a", Value: map[string]any{"s": "hello"}})
+		if err != nil {
+			t.Fatalf("failed to encode record: %s", err)
+		}
+		for i := 0; i < len(b); i++ {
+			if _, err := unmarshalRecord(b[:i]); err == nil {
+				t.Fatalf("expected an error decoding %d of %d bytes", i, len(b))
+			}
+		}
+		if _, err := unmarshalRecord(append(b, 0)); err == nil {
+			t.Fatalf("expected an error decoding trailing bytes")
+		}
+	})
+	t.Run("should read values back with the same types before and after a flush", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"n": 1, "s": []string{"x"}}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		before, err := tree.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		flushTestTree(t, tree)
+		after, err := tree.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Fatalf("expected %#v after the flush, got %#v", before, after)
+		}
+	})
+}
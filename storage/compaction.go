@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultCompactionWorkers is the default number of background
+// compaction workers per tree.
+const DefaultCompactionWorkers = 1
+
+// DefaultTargetTableSize is the default size, in bytes, at which
+// a level compaction starts a new output table.
+const DefaultTargetTableSize = 2 << 20
+
+// compactionJob is a single unit of compaction work.
+type compactionJob struct {
+	flush  bool // Flush the frozen (or full) memtable into the first level
+	level  int  // Otherwise, the index of the level to compact...
+	output int  // ...and the index of the level to compact it into
+}
+
+func (j compactionJob) String() string {
+	if j.flush {
+		return "memtable flush"
+	}
+	return fmt.Sprintf("level %d compaction", j.level+1)
+}
+
+// compactor schedules a tree's memtable flushes and level
+// compactions, and runs them on a pool of background workers.
+//
+// Workers are woken up by schedule (e.g. after a write fills
+// the memtable) and keep picking jobs until there's nothing left
+// to do. Jobs never overlap -- at most one flush runs at a time,
+// and a level compaction claims both its input and output levels.
+type compactor struct {
+	sync.Mutex
+	tree     *LSMTree
+	workers  int
+	wake     chan struct{} // Signals idle workers to look for work
+	quit     chan struct{} // Closed to stop the workers
+	wg       sync.WaitGroup
+	flushing bool         // Whether a memtable flush is running
+	busy     map[int]bool // Indexes of levels being compacted (as input or output)
+	errs     []jobError   // The last error from each background job that's failed
+	stopped  bool
+}
+
+// jobError is an error from a background job.
+type jobError struct {
+	job compactionJob
+	err error
+}
+
+// newCompactor creates a compactor for the tree with the given
+// number of workers. If workers is zero, DefaultCompactionWorkers
+// is used; if it's negative, there are no background workers and
+// jobs only run when LSMTree.Compact is called.
+func newCompactor(t *LSMTree, workers int) *compactor {
+	if workers == 0 {
+		workers = DefaultCompactionWorkers
+	}
+	return &compactor{
+		tree:    t,
+		workers: workers,
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		busy:    make(map[int]bool),
+	}
+}
+
+// start starts the background workers, and schedules a first
+// pass (in case there's work left over from before a restart).
+func (c *compactor) start() {
+	for i := 0; i < c.workers; i++ {
+		c.wg.Add(1)
+		go c.worker()
+	}
+	c.schedule()
+}
+
+// stop signals the workers to stop and waits for them to finish
+// the jobs they're running.
+func (c *compactor) stop() {
+	c.Lock()
+	if c.stopped {
+		c.Unlock()
+		return
+	}
+	c.stopped = true
+	c.Unlock()
+
+	close(c.quit)
+	c.wg.Wait()
+}
+
+// schedule wakes up an idle worker (if there is one) to look
+// for work. It never blocks.
+func (c *compactor) schedule() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *compactor) worker() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-c.wake:
+		}
+
+		for {
+			// Stop between jobs if we're shutting down
+			select {
+			case <-c.quit:
+				return
+			default:
+			}
+
+			job, ok := c.pick()
+			if !ok {
+				break
+			}
+
+			// There may be more work another worker can do in parallel
+			c.schedule()
+
+			err := c.run(job)
+			c.finish(job)
+			if err != nil {
+				// Report it and wait to be woken up again, rather
+				// than retrying a failing job in a loop
+				c.report(job, fmt.Errorf("background %s failed: %w", job, err))
+				break
+			}
+		}
+	}
+}
+
+// runAll runs jobs on the caller's goroutine until there's
+// nothing left to do (or nothing that isn't already running),
+// returning the first error.
+func (c *compactor) runAll() error {
+	for {
+		job, ok := c.pick()
+		if !ok {
+			return nil
+		}
+		err := c.run(job)
+		c.finish(job)
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", job, err)
+		}
+	}
+}
+
+// pick chooses the next job to run, and claims the resources it
+// needs. Memtable flushes come first, so writes aren't held up,
+// then level compactions, top down.
+func (c *compactor) pick() (compactionJob, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	t := c.tree
+	t.RLock()
+	defer t.RUnlock()
+
+	// Does the memtable need to be flushed?
+	if !c.flushing && (t.frozenMemtable != nil || t.memtable.Full()) {
+		c.flushing = true
+		return compactionJob{flush: true}, true
+	}
+
+	// Do any of the levels need to be compacted?
+	for i, level := range t.levels {
+		if c.busy[i] || !t.strategy.NeedsCompaction(level) {
+			continue
+		}
+		out := int(t.strategy.OutputLevel(level)) - 1
+		if out < i || c.busy[out] {
+			continue
+		}
+		c.busy[i] = true
+		c.busy[out] = true
+		return compactionJob{level: i, output: out}, true
+	}
+	return compactionJob{}, false
+}
+
+// finish releases the resources claimed for the job.
+func (c *compactor) finish(job compactionJob) {
+	c.Lock()
+	defer c.Unlock()
+	if job.flush {
+		c.flushing = false
+		return
+	}
+	delete(c.busy, job.level)
+	delete(c.busy, job.output)
+}
+
+func (c *compactor) run(job compactionJob) error {
+	if job.flush {
+		return c.tree.flush()
+	}
+	return c.tree.compactLevel(job.level, job.output)
+}
+
+// report records an error from a background job.
+//
+// Only the last error from each job is kept, since a job that
+// keeps failing (e.g. because the disk is full) is retried every
+// time a worker is woken up.
+func (c *compactor) report(job compactionJob, err error) {
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.errs {
+		if c.errs[i].job == job {
+			c.errs[i].err = err
+			return
+		}
+	}
+	c.errs = append(c.errs, jobError{job: job, err: err})
+}
+
+// err returns the errors from background jobs so far.
+func (c *compactor) err() error {
+	c.Lock()
+	defer c.Unlock()
+	errs := make([]error, len(c.errs))
+	for i, e := range c.errs {
+		errs[i] = e.err
+	}
+	return errors.Join(errs...)
+}
+
+// ids returns the ids of the tables in ts.
+func ids(ts []*SSTable) []string {
+	ids := make([]string, len(ts))
+	for i, t := range ts {
+		ids[i] = t.meta.ID
+	}
+	return ids
+}
+
+// compactLevel compacts tables from the level at index i into the
+// level at index out, adding levels first if needed.
+//
+// The tree's CompactionStrategy picks the level's tables to compact
+// and the tables in the output level to merge them with, and they're
+// all replaced by the merged tables.
+func (t *LSMTree) compactLevel(i, out int) error {
+	if out < i {
+		return fmt.Errorf("can't compact level %d into level %d", i+1, out+1)
+	}
+
+	// Get the levels, adding the output level if needed
+	t.Lock()
+	for out >= len(t.levels) {
+		if err := t.addLevel(); err != nil {
+			t.Unlock()
+			return fmt.Errorf("failed to add level: %w", err)
+		}
+	}
+	level, outLevel := t.levels[i], t.levels[out]
+	between := slices.Clone(t.levels[i+1 : out+1])
+	bottommost := out == len(t.levels)-1
+	t.Unlock()
+
+	// Pick the tables to compact
+	inputs, overlap := t.strategy.PickInputs(level, outLevel)
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	// When compacting into the bottommost level, there's nothing
+	// below for tombstones to shadow, so they can be dropped -- as
+	// long as no snapshot is old enough to need the versions they
+	// shadow, and no table that isn't part of the compaction might
+	// still hold one. Likewise, merge records can be folded into
+	// full values, since there's nothing older left to merge with
+	var all func(k string) bool
+	var drop func(r Record) bool
+	if bottommost {
+		oldest := t.oldestSnapshot()
+		var others []*SSTable
+		for _, l := range between {
+			for _, table := range l.Tables() {
+				if !slices.Contains(overlap, table) {
+					others = append(others, table)
+				}
+			}
+		}
+		all = func(k string) bool {
+			return !mightContain(others, k)
+		}
+		drop = func(r Record) bool {
+			return r.Tomb && r.Seq <= oldest && all(r.Key)
+		}
+	}
+
+	// Merge them into the output level's directory
+	tables, err := t.runCompaction(inputs, overlap, outLevel, all, drop)
+	if err != nil {
+		return fmt.Errorf("failed to compact level %d: %w", i+1, err)
+	}
+
+	// Log the change as a single edit, so it's applied all at once
+	edit := versionEdit{
+		Added:   refs(outLevel.Number(), tables),
+		Removed: append(refs(outLevel.Number(), overlap), refs(level.Number(), inputs)...),
+		LastSeq: t.seq.Load(),
+	}
+	if err := t.manifest.Log(edit); err != nil {
+		for _, table := range tables {
+			table.remove()
+		}
+		return fmt.Errorf("failed to log compaction of level %d: %w", i+1, err)
+	}
+
+	// Swap the new tables in for the overlapping ones in the output
+	// level, then delete the inputs
+	//
+	// This is done under the tree's write lock, so readers see
+	// either the old tables or the new ones -- never both, which
+	// would apply merge records twice. Both swaps always happen (see
+	// ReplaceTables), so any errors are only from cleaning up
+	t.Lock()
+	defer t.Unlock()
+	var errs []error
+	if err := outLevel.ReplaceTables(tables, ids(overlap)); err != nil {
+		errs = append(errs, fmt.Errorf("failed to clean up level %d after compacting level %d into it: %w", out+1, i+1, err))
+	}
+	if err := level.DeleteTables(ids(inputs)); err != nil {
+		errs = append(errs, fmt.Errorf("failed to clean up old tables from level %d: %w", i+1, err))
+	}
+	return errors.Join(errs...)
+}
+
+// runCompaction merges the input tables and the overlapping tables
+// into new tables in the output level. If the output level is
+// partitioned, it starts a new table whenever one reaches the
+// tree's target table size.
+//
+// Merge records are folded together with the tree's merge operator
+// -- and into a full value if all (when it isn't nil) returns true
+// for their key, meaning there are no older versions outside the
+// compaction. Records for which drop returns true (if it isn't nil)
+// are left out of the new tables.
+func (t *LSMTree) runCompaction(inputs, overlap []*SSTable, out *Level, all func(k string) bool, drop func(r Record) bool) ([]*SSTable, error) {
+	// Gather the sources, newest first -- the inputs are all newer
+	// than the overlapping tables below them
+	var children []recordIterator
+	for i := len(inputs) - 1; i >= 0; i-- {
+		children = append(children, newTableIterator(inputs[i]))
+	}
+	for _, table := range overlap {
+		children = append(children, newTableIterator(table))
+	}
+	itr := newMergingIterator(children)
+	itr.op = t.merge
+	itr.all = func(k string) bool {
+		return all != nil && all(k)
+	}
+	defer itr.close()
+
+	// Write the merged records, so that the newest version of each
+	// key wins (tombstones included, unless they're dropped, since
+	// they may still shadow keys in lower levels)
+	var tables []*SSTable
+	var builder *SSTBuilder
+	cleanup := func() {
+		if builder != nil {
+			builder.abort()
+		}
+		for _, table := range tables {
+			table.remove()
+		}
+	}
+	finish := func() error {
+		table, err := builder.Finish()
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+		builder = nil
+		return nil
+	}
+	now := time.Now()
+	for itr.next() {
+		// Expired records can't be read any more, but they may still
+		// shadow older versions of their keys in lower levels, so
+		// they're kept as tombstones (which may then be dropped)
+		r := itr.record()
+		if r.expired(now) {
+			r = Record{Key: r.Key, Seq: r.Seq, Tomb: true}
+		}
+		if drop != nil && drop(r) {
+			continue
+		}
+
+		// Start a new table, if needed
+		if builder == nil {
+			builder = t.newBuilder(out)
+			if err := builder.SetUp(); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+
+		// Add the record
+		if err := builder.Add(r); err != nil {
+			cleanup()
+			return nil, err
+		}
+
+		// Finish the table if it's big enough
+		if out.partitioned && builder.Size() >= t.tableSize {
+			if err := finish(); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+	}
+	if err := itr.err(); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if builder != nil {
+		if err := finish(); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	// Done
+	return tables, nil
+}
+
+// mightContain returns true if any of the tables might hold the key.
+func mightContain(tables []*SSTable, k string) bool {
+	for _, t := range tables {
+		if !t.overlaps(k, k) {
+			continue
+		}
+		if ok, err := t.MightContain(k); ok || err != nil {
+			return true
+		}
+	}
+	return false
+}
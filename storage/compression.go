@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// NoCompression is the name of the codec that stores
+	// blocks as-is. It's the default.
+	NoCompression = "none"
+
+	// DeflateCompression is the name of the codec that
+	// compresses blocks with DEFLATE (compress/flate).
+	DeflateCompression = "deflate"
+)
+
+// Compressor compresses and decompresses SSTable data blocks.
+//
+// A table's compressor is recorded (by name) in its metadata, so
+// tables written with different compressors can live in the same
+// tree -- as long as every compressor they use is registered.
+type Compressor interface {
+	// Name identifies the compressor in table metadata.
+	Name() string
+
+	// Compress returns the compressed form of b.
+	Compress(b []byte) ([]byte, error)
+
+	// Decompress returns the original form of b.
+	Decompress(b []byte) ([]byte, error)
+}
+
+var compressors = struct {
+	sync.RWMutex
+	byName map[string]Compressor
+}{
+	byName: map[string]Compressor{
+		NoCompression:      noCompressor{},
+		DeflateCompression: deflateCompressor{},
+	},
+}
+
+// RegisterCompressor makes the compressor available to tables,
+// by its name. It returns an error if a compressor with the same
+// name is already registered.
+func RegisterCompressor(c Compressor) error {
+	compressors.Lock()
+	defer compressors.Unlock()
+	if _, ok := compressors.byName[c.Name()]; ok {
+		return fmt.Errorf("compressor %q is already registered", c.Name())
+	}
+	compressors.byName[c.Name()] = c
+	return nil
+}
+
+// getCompressor returns the registered compressor with the
+// given name. An empty name means NoCompression, for tables
+// written before compression was supported.
+func getCompressor(name string) (Compressor, error) {
+	if name == "" {
+		name = NoCompression
+	}
+	compressors.RLock()
+	defer compressors.RUnlock()
+	c, ok := compressors.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor %q", name)
+	}
+	return c, nil
+}
+
+// noCompressor stores blocks uncompressed.
+type noCompressor struct{}
+
+func (noCompressor) Name() string {
+	return NoCompression
+}
+
+func (noCompressor) Compress(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (noCompressor) Decompress(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+// deflateCompressor compresses blocks with DEFLATE.
+type deflateCompressor struct{}
+
+func (deflateCompressor) Name() string {
+	return DeflateCompression
+}
+
+func (deflateCompressor) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	return io.ReadAll(r)
+}
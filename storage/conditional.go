@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConditionFailed is returned by conditional writes (like
+// PutIfAbsent and CompareAndSwap) when the key isn't in the state
+// the write expected, in which case nothing is written.
+var ErrConditionFailed = errors.New("condition failed")
+
+// PutIfAbsent sets the value of the key k to v, but only if the
+// key doesn't exist (or was deleted, or has expired). Otherwise,
+// it returns ErrConditionFailed.
+func (t *LSMTree) PutIfAbsent(k string, v map[string]any) error {
+	return t.writeIfVersion(Record{Key: k, Value: v}, func(seq uint64) error {
+		if seq != 0 {
+			return fmt.Errorf("key %q already exists: %w", k, ErrConditionFailed)
+		}
+		return nil
+	})
+}
+
+// CompareAndSwap sets the value of the key k to v, but only if
+// the key is still at version expectedSeq (see GetVersion).
+// Otherwise, it returns ErrConditionFailed.
+//
+// An expectedSeq of 0 means the key must not exist, like
+// PutIfAbsent.
+func (t *LSMTree) CompareAndSwap(k string, expectedSeq uint64, v map[string]any) error {
+	return t.writeIfVersion(Record{Key: k, Value: v}, versionIs(k, expectedSeq))
+}
+
+// DeleteIfVersion deletes the key k, but only if it's still at
+// version expectedSeq (see GetVersion). Otherwise, it returns
+// ErrConditionFailed.
+func (t *LSMTree) DeleteIfVersion(k string, expectedSeq uint64) error {
+	return t.writeIfVersion(Record{Key: k, Tomb: true}, versionIs(k, expectedSeq))
+}
+
+// versionIs returns a check for writeIfVersion that the key k
+// is at version expected.
+func versionIs(k string, expected uint64) func(seq uint64) error {
+	return func(seq uint64) error {
+		if seq != expected {
+			return fmt.Errorf("key %q is at version %d, not %d: %w", k, seq, expected, ErrConditionFailed)
+		}
+		return nil
+	}
+}
+
+// writeIfVersion writes the record if check returns nil for the
+// current version of its key.
+//
+// The version is looked up under the active memtable's write
+// lock, across the memtables and every level, so no other write
+// can change it between the check and the write.
+func (t *LSMTree) writeIfVersion(r Record, check func(seq uint64) error) error {
+	if err := checkKey(r.Key); err != nil {
+		return err
+	}
+	t.RLock()
+	defer t.RUnlock()
+	defer t.maybeFlush()
+	return t.memtable.writeIf([]Record{r}, func() error {
+		seq, err := t.versionLocked(r.Key)
+		if err != nil {
+			return err
+		}
+		return check(seq)
+	})
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLSMTree_ConditionalWrites(t *testing.T) {
+	t.Run("should only put keys that don't exist", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.PutIfAbsent("a", map[string]any{"n": 1}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.PutIfAbsent("a", map[string]any{"n": 2}); !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("expected ErrConditionFailed for an existing key, got %v", err)
+		}
+		if v, err := tree.Get("a"); err != nil || v["n"] != int64(1) {
+			t.Fatalf("expected the key to be unchanged, got %v (err=%v)", v, err)
+		}
+
+		// Deleted and expired keys count as missing
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if err := tree.PutIfAbsent("a", map[string]any{"n": 3}); err != nil {
+			t.Fatalf("failed to put a deleted key: %s", err)
+		}
+		if err := tree.PutWithTTL("b", map[string]any{"n": 1}, time.Millisecond); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if err := tree.PutIfAbsent("b", map[string]any{"n": 2}); err != nil {
+			t.Fatalf("failed to put an expired key: %s", err)
+		}
+	})
+
+	t.Run("should compare and swap against the latest version", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"n": 1}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		_, seq, err := tree.GetVersion("a")
+		if err != nil {
+			t.Fatalf("failed to get version: %s", err)
+		}
+
+		// The version should survive being compacted into a level
+		flushTestTree(t, tree)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if err := tree.CompareAndSwap("a", seq+1, map[string]any{"n": 2}); !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("expected ErrConditionFailed for the wrong version, got %v", err)
+		}
+		if err := tree.CompareAndSwap("a", seq, map[string]any{"n": 2}); err != nil {
+			t.Fatalf("failed to compare and swap: %s", err)
+		}
+		if err := tree.CompareAndSwap("a", seq, map[string]any{"n": 3}); !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("expected ErrConditionFailed for a stale version, got %v", err)
+		}
+		v, newSeq, err := tree.GetVersion("a")
+		if err != nil {
+			t.Fatalf("failed to get version: %s", err)
+		}
+		if v["n"] != int64(2) || newSeq <= seq {
+			t.Fatalf("expected n=2 at a newer version than %d, got %v at %d", seq, v, newSeq)
+		}
+
+		// Version 0 means the key doesn't exist
+		if err := tree.CompareAndSwap("b", 0, map[string]any{"n": 1}); err != nil {
+			t.Fatalf("failed to compare and swap a missing key: %s", err)
+		}
+	})
+
+	t.Run("should count merges as new versions", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{CompactionWorkers: -1, MergeOperator: AddMergeOperator})
+		if err := tree.Merge("a", map[string]any{"n": 1}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		if err := tree.PutIfAbsent("a", map[string]any{"n": 5}); !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("expected a merged key to exist, got %v", err)
+		}
+		_, seq, err := tree.GetVersion("a")
+		if err != nil {
+			t.Fatalf("failed to get version: %s", err)
+		}
+		if err := tree.Merge("a", map[string]any{"n": 1}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		if err := tree.DeleteIfVersion("a", seq); !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("expected ErrConditionFailed after a merge, got %v", err)
+		}
+	})
+
+	t.Run("should delete only the expected version", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"n": 1}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		_, seq, err := tree.GetVersion("a")
+		if err != nil {
+			t.Fatalf("failed to get version: %s", err)
+		}
+		if err := tree.DeleteIfVersion("a", seq-1); !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("expected ErrConditionFailed for the wrong version, got %v", err)
+		}
+		if err := tree.DeleteIfVersion("a", seq); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if v, seq, err := tree.GetVersion("a"); err != nil || v != nil || seq != 0 {
+			t.Fatalf("expected the key to be deleted, got %v at %d (err=%v)", v, seq, err)
+		}
+	})
+
+	t.Run("should reject empty keys", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.PutIfAbsent("", map[string]any{"n": 1}); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey from PutIfAbsent, got %v", err)
+		}
+		if err := tree.CompareAndSwap("", 0, map[string]any{"n": 1}); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey from CompareAndSwap, got %v", err)
+		}
+		if err := tree.DeleteIfVersion("", 0); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey from DeleteIfVersion, got %v", err)
+		}
+	})
+
+	t.Run("should let only one concurrent writer win", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("leader", map[string]any{"id": -1}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		_, seq, err := tree.GetVersion("leader")
+		if err != nil {
+			t.Fatalf("failed to get version: %s", err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = tree.CompareAndSwap("leader", seq, map[string]any{"id": i})
+			}()
+		}
+		wg.Wait()
+
+		winner := -1
+		for i, err := range errs {
+			switch {
+			case err == nil && winner == -1:
+				winner = i
+			case err == nil:
+				t.Fatalf("expected one winner, got %d and %d", winner, i)
+			case !errors.Is(err, ErrConditionFailed):
+				t.Fatalf("failed to compare and swap: %s", err)
+			}
+		}
+		if v, err := tree.Get("leader"); err != nil || winner == -1 || v["id"] != int64(winner) {
+			t.Fatalf("expected leader %d, got %v (err=%v)", winner, v, err)
+		}
+	})
+}
@@ -9,6 +9,7 @@
 //
 //	path/to/tree/
 //	|-- _meta.json
+//	|-- MANIFEST
 //	|-- wals/
 //	|   +-- {{ WAL_ID }}.wal
 //	+-- levels/
@@ -17,7 +18,8 @@
 //	        +-- {{ ID_OF_SST }}/
 //	            |-- _meta.json
 //	            |-- data.dat
-//	            +-- bloom.dat
+//	            |-- bloom.dat
+//	            +-- prefix.dat (optional)
 //
 // Where in the above, LEVEL_NUM is the level number, width-4, zero-padded.
 // There are zero or more levels per tree.
@@ -25,7 +27,12 @@
 // And ID_OF_SST is the ID of the SSTable, which is a UUID. There is (generally)
 // at least one table per level. The tables for a given level are stored in the
 // same directory -- where each table has a data file, a meta file, and a bloom
-// filter file.
+// filter file (plus a prefix bloom filter file, if prefix filters are enabled).
+//
+// The MANIFEST is an append-only log of the changes to the set of levels and
+// tables. It's replayed when the tree is loaded, so the levels always match
+// the last change that was logged in full, and any table directories it
+// doesn't mention (e.g. from an interrupted compaction) are removed.
 //
 // Done
 package storage
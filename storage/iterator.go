@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+)
+
+// Iterator iterates over a range of a tree's live keys, in
+// ascending key order.
+//
+// Call Next to advance to the first (and each following) key,
+// before calling Key or Value:
+//
+//	it := tree.Scan("a", "b")
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator interface {
+	// Seek repositions the iterator so that the next call
+	// to Next moves to the first key >= k (within the
+	// iterator's bounds).
+	Seek(k string)
+
+	// Next advances to the next key, returning false when
+	// there are no more keys in range (or an error occurs).
+	Next() bool
+
+	// Key returns the current key.
+	Key() string
+
+	// Value returns the current key's value.
+	Value() map[string]any
+
+	// Err returns the first error hit while iterating, if any.
+	Err() error
+
+	// Close releases the iterator's resources.
+	Close() error
+}
+
+// recordIterator is a pull-based iterator over records in a
+// single source (a memtable or an SSTable), in key order.
+//
+// Tombstones are included.
+type recordIterator interface {
+	// seek repositions the iterator so that the next call
+	// to next moves to the first record with a key >= k.
+	seek(k string)
+
+	// next advances to the next record, returning false
+	// when the iterator is exhausted (or fails).
+	next() bool
+
+	// record returns the current record.
+	record() Record
+
+	// err returns the error that stopped the iterator, if any.
+	err() error
+
+	// close releases the iterator's resources.
+	close() error
+}
+
+// memtableIterator iterates over the newest version of each
+// key in a memtable, with a sequence number <= seq -- along with
+// the older versions it needs, if it's a merge record (up to the
+// first one that isn't).
+//
+// Since memtables are small, it copies the records from its
+// seek position onwards when it's positioned, so it isn't
+// affected by writes made while iterating.
+type memtableIterator struct {
+	m       *Memtable
+	seq     uint64
+	records []Record
+	pos     int
+	seeked  bool
+}
+
+func newMemtableIterator(m *Memtable, seq uint64) *memtableIterator {
+	return &memtableIterator{m: m, seq: seq}
+}
+
+func (it *memtableIterator) seek(k string) {
+	it.m.RLock()
+	defer it.m.RUnlock()
+
+	it.records = it.records[:0]
+	it.m.tree.AscendGreaterOrEqual(Record{Key: k, Seq: math.MaxUint64}, func(r Record) bool {
+		// Skip versions that are too new, or older than
+		// one we already have (unless it merges with them)
+		if r.Seq > it.seq {
+			return true
+		}
+		if n := len(it.records); n > 0 && it.records[n-1].Key == r.Key && !it.records[n-1].Merge {
+			return true
+		}
+		it.records = append(it.records, r)
+		return true
+	})
+	it.pos = -1
+	it.seeked = true
+}
+
+func (it *memtableIterator) next() bool {
+	if !it.seeked {
+		it.seek("")
+	}
+	if it.pos < len(it.records) {
+		it.pos++
+	}
+	return it.pos < len(it.records)
+}
+
+func (it *memtableIterator) record() Record {
+	return it.records[it.pos]
+}
+
+func (it *memtableIterator) err() error {
+	return nil
+}
+
+func (it *memtableIterator) close() error {
+	it.records = nil
+	return nil
+}
+
+// tableIterator iterates over the records in an SSTable,
+// reading one data block at a time.
+type tableIterator struct {
+	t       *SSTable
+	block   int      // Position of the current block in the index
+	records []Record // The current block's records
+	pos     int      // Position in the current block
+	seeked  bool
+	e       error
+}
+
+func newTableIterator(t *SSTable) *tableIterator {
+	return &tableIterator{t: t}
+}
+
+func (it *tableIterator) seek(k string) {
+	it.seeked = true
+	it.e = nil
+
+	// Find the block that would hold the key
+	it.block = max(it.t.index.find(k), 0)
+	if !it.load() {
+		return
+	}
+
+	// Position just before the first key >= k
+	it.pos = searchBlock(it.records, k) - 1
+}
+
+// load reads in the current block, leaving the position
+// just before its first record.
+func (it *tableIterator) load() bool {
+	it.records = nil
+	it.pos = -1
+	if it.block >= len(it.t.index.blocks) {
+		return false
+	}
+	records, err := it.t.readBlock(it.t.index.blocks[it.block])
+	if err != nil {
+		it.e = err
+		return false
+	}
+	it.records = records
+	return true
+}
+
+func (it *tableIterator) next() bool {
+	if !it.seeked {
+		it.seek("")
+	}
+	if it.e != nil {
+		return false
+	}
+	for {
+		if it.pos+1 < len(it.records) {
+			it.pos++
+			return true
+		}
+
+		// Move on to the next block
+		if it.block >= len(it.t.index.blocks) {
+			return false
+		}
+		it.block++
+		if !it.load() {
+			return false
+		}
+	}
+}
+
+func (it *tableIterator) record() Record {
+	return it.records[it.pos]
+}
+
+func (it *tableIterator) err() error {
+	return it.e
+}
+
+func (it *tableIterator) close() error {
+	it.records = nil
+	return nil
+}
+
+// mergingIterator merges several record iterators into one,
+// in key order, using a min-heap of the children's current
+// records.
+//
+// When more than one child has the same key, the record with
+// the highest sequence number wins and the others are skipped.
+// (If the sequence numbers are equal, the earliest child wins.)
+// If the winner is a merge record, the older versions it needs
+// are folded into it with the merge operator op.
+type mergingIterator struct {
+	children []recordIterator
+	heap     mergeHeap           // Children positioned on a record
+	primed   bool                // Whether the children have been positioned
+	op       MergeOperator       // Folds merge records (may be nil, if there aren't any)
+	all      func(k string) bool // Whether the children hold every version of a key (nil means they always do)
+	chain    versionChain        // The current key's versions, while they're being folded
+	current  Record
+	e        error
+}
+
+func newMergingIterator(children []recordIterator) *mergingIterator {
+	return &mergingIterator{
+		children: children,
+		heap: mergeHeap{
+			children: children,
+			idx:      make([]int, 0, len(children)),
+		},
+	}
+}
+
+func (it *mergingIterator) seek(k string) {
+	it.e = nil
+	it.heap.idx = it.heap.idx[:0]
+	for i, c := range it.children {
+		c.seek(k)
+		if it.advance(i) {
+			it.heap.idx = append(it.heap.idx, i)
+		}
+	}
+	heap.Init(&it.heap)
+	it.primed = true
+}
+
+// advance moves the i-th child forward, recording its
+// error if it stops because of one.
+func (it *mergingIterator) advance(i int) bool {
+	c := it.children[i]
+	if c.next() {
+		return true
+	}
+	if err := c.err(); err != nil && it.e == nil {
+		it.e = err
+	}
+	return false
+}
+
+func (it *mergingIterator) next() bool {
+	if !it.primed {
+		it.seek("")
+	}
+	if it.e != nil || it.heap.Len() == 0 {
+		return false
+	}
+
+	// The top of the heap is the newest version of the lowest key
+	newest := it.children[it.heap.idx[0]].record()
+
+	// Step past the key in every child that has it, collecting
+	// the older versions the newest one merges with
+	it.chain = append(it.chain[:0], newest)
+	for it.heap.Len() > 0 {
+		i := it.heap.idx[0]
+		r := it.children[i].record()
+		if r.Key != newest.Key {
+			break
+		}
+		if !it.chain.complete() && r.Seq < it.chain[len(it.chain)-1].Seq {
+			it.chain = append(it.chain, r)
+		}
+		if it.advance(i) {
+			heap.Fix(&it.heap, 0)
+		} else {
+			heap.Pop(&it.heap)
+		}
+	}
+	if it.e != nil {
+		return false
+	}
+
+	// Fold them together
+	r, err := it.chain.fold(it.op, it.all == nil || it.all(newest.Key))
+	if err != nil {
+		it.e = err
+		return false
+	}
+	it.current = r
+	return true
+}
+
+func (it *mergingIterator) record() Record {
+	return it.current
+}
+
+func (it *mergingIterator) err() error {
+	return it.e
+}
+
+func (it *mergingIterator) close() error {
+	var errs []error
+	for _, c := range it.children {
+		if err := c.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mergeHeap is a min-heap (implementing heap.Interface) of the
+// indexes of children, ordered by their current record's key,
+// then by sequence number (newest first), then by the child's
+// index.
+type mergeHeap struct {
+	children []recordIterator
+	idx      []int
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.idx)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	ri := h.children[h.idx[i]].record()
+	rj := h.children[h.idx[j]].record()
+	if ri.Key != rj.Key {
+		return ri.Key < rj.Key
+	}
+	if ri.Seq != rj.Seq {
+		return ri.newer(rj)
+	}
+	return h.idx[i] < h.idx[j]
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.idx[i], h.idx[j] = h.idx[j], h.idx[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.idx = append(h.idx, x.(int))
+}
+
+func (h *mergeHeap) Pop() any {
+	n := len(h.idx)
+	x := h.idx[n-1]
+	h.idx = h.idx[:n-1]
+	return x
+}
+
+// treeIterator is the Iterator returned by LSMTree.Scan. It
+// hides tombstones and keeps to the half-open range [start, end).
+type treeIterator struct {
+	merged *mergingIterator
+	start  string
+	end    string // An empty end means no upper bound
+	key    string
+	value  map[string]any
+	done   bool
+	snap   *Snapshot // A snapshot owned by the iterator (released on Close)
+	e      error     // An error that stops the iterator before it starts (e.g. a released snapshot)
+}
+
+func (it *treeIterator) Seek(k string) {
+	if k < it.start {
+		k = it.start
+	}
+	it.merged.seek(k)
+	it.done = false
+}
+
+func (it *treeIterator) Next() bool {
+	if it.done || it.e != nil {
+		return false
+	}
+	for it.merged.next() {
+		r := it.merged.record()
+
+		// Have we passed the end of the range?
+		if it.end != "" && r.Key >= it.end {
+			break
+		}
+
+		// Skip deleted (and expired) keys
+		if !r.live() {
+			continue
+		}
+
+		it.key = r.Key
+		it.value = r.Value
+		return true
+	}
+	it.done = true
+	it.key = ""
+	it.value = nil
+	return false
+}
+
+func (it *treeIterator) Key() string {
+	return it.key
+}
+
+func (it *treeIterator) Value() map[string]any {
+	return cloneValue(it.value)
+}
+
+func (it *treeIterator) Err() error {
+	if it.e != nil {
+		return it.e
+	}
+	return it.merged.err()
+}
+
+func (it *treeIterator) Close() error {
+	it.done = true
+	err := it.merged.close()
+	if it.snap != nil {
+		err = errors.Join(err, it.snap.Release())
+		it.snap = nil
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestLSMTree_Scan(t *testing.T) {
+	// collect drains the iterator, returning its keys
+	collect := func(t *testing.T, it Iterator) []string {
+		t.Helper()
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("failed to iterate: %s", err)
+		}
+		return keys
+	}
+
+	t.Run("should merge the memtable and tables in key order", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+
+		// Oldest table
+		for _, k := range []string{"a", "c", "e", "g"} {
+			if err := tree.Put(k, map[string]any{"v": 1.0}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		flushTestTree(t, tree)
+
+		// Newer table, overwriting and deleting some keys
+		if err := tree.Put("c", map[string]any{"v": 2.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Del("e"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if err := tree.Put("b", map[string]any{"v": 2.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+
+		// Memtable
+		if err := tree.Put("g", map[string]any{"v": 3.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if err := tree.Put("f", map[string]any{"v": 3.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+
+		it := tree.Scan("", "")
+		defer it.Close()
+		expected := map[string]float64{"b": 2, "c": 2, "f": 3, "g": 3}
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+			if v := it.Value()["v"]; v != expected[it.Key()] {
+				t.Fatalf("expected key %q to have v=%v, got %v", it.Key(), expected[it.Key()], v)
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("failed to iterate: %s", err)
+		}
+		if !slices.Equal(keys, []string{"b", "c", "f", "g"}) {
+			t.Fatalf("expected keys [b c f g], got %v", keys)
+		}
+	})
+
+	t.Run("should honor half-open bounds and seek", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		for _, k := range []string{"a", "b", "c", "d", "e"} {
+			if err := tree.Put(k, map[string]any{}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		flushTestTree(t, tree)
+
+		it := tree.Scan("b", "d")
+		defer it.Close()
+		if keys := collect(t, it); !slices.Equal(keys, []string{"b", "c"}) {
+			t.Fatalf("expected keys [b c], got %v", keys)
+		}
+
+		// Seeking before the start should clamp to it
+		it.Seek("a")
+		if keys := collect(t, it); !slices.Equal(keys, []string{"b", "c"}) {
+			t.Fatalf("expected keys [b c], got %v", keys)
+		}
+
+		it.Seek("c")
+		if keys := collect(t, it); !slices.Equal(keys, []string{"c"}) {
+			t.Fatalf("expected keys [c], got %v", keys)
+		}
+	})
+}
+
+func TestLSMTree_ScanPrefix(t *testing.T) {
+	t.Run("should skip tables without the prefix", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1, PrefixBloomLength: 2})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		defer tree.Close()
+
+		// Write two tables with overlapping key ranges, where
+		// only the first has keys starting with "c-"
+		for _, keys := range [][]string{{"a-1", "c-1", "c-2"}, {"a-2", "d-1"}} {
+			for _, k := range keys {
+				if err := tree.Put(k, map[string]any{"k": k}); err != nil {
+					t.Fatalf("failed to put: %s", err)
+				}
+			}
+			flushTestTree(t, tree)
+		}
+
+		it := tree.ScanPrefix("c-")
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Close(); err != nil {
+			t.Fatalf("failed to close iterator: %s", err)
+		}
+		if !slices.Equal(keys, []string{"c-1", "c-2"}) {
+			t.Fatalf("expected keys [c-1 c-2], got %v", keys)
+		}
+
+		// Only the first table's block should have been read
+		if stats := tree.BlockCacheStats(); stats.Misses != 1 {
+			t.Fatalf("expected 1 block to be read, got %+v", stats)
+		}
+	})
+}
@@ -1,279 +1,612 @@
 package storage
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path"
 	"slices"
+	"sort"
+	"strings"
 	"sync"
-	"time"
 )
 
-// DefaultLevelMaxSize is the default maximum number
-// of tables that can be stored in a level.
+// DefaultLevelMaxSize is the default maximum number of tables
+// that can be stored in the first level.
 const DefaultLevelMaxSize = 10
 
+const (
+	// DefaultLevelBaseBytes is the default maximum total size of
+	// the tables in level 2. Each level after that is
+	// DefaultLevelSizeRatio times bigger than the one before.
+	DefaultLevelBaseBytes = 10 << 20
+
+	// DefaultLevelSizeRatio is the default ratio between the
+	// maximum sizes of consecutive levels (from level 2 down).
+	DefaultLevelSizeRatio = 10
+)
+
+// DefaultTombstoneRatio is the ratio of tombstones to records
+// at which a table is picked for compaction ahead of the others.
+const DefaultTombstoneRatio = 0.5
+
+const LevelMetaFileName = "_meta.json"
+
+// ErrMissingTable is returned when loading a level whose
+// metadata lists a table that isn't on disk.
+var ErrMissingTable = errors.New("missing table")
+
+// Level is a level of an LSMTree, made up of SSTables.
+//
+// A level's tables either overlap, and are kept in the order they
+// were added, or are partitioned -- they have non-overlapping key
+// ranges and are sorted by key, so at most one table in the level
+// can hold a given key. Which one depends on the tree's
+// CompactionStrategy; by default, only the first level overlaps.
 type Level struct {
 	sync.RWMutex
-	path   string     // The path to this level's directory on disk
-	meta   LevelMeta  // The level's metadata
-	tables []*SSTable // Handles to the level's tables
+	path        string      // The path to this level's directory on disk
+	meta        LevelMeta   // The level's metadata
+	tables      []*SSTable  // Handles to the level's tables
+	orphans     []string    // IDs of table dirs on disk that aren't in the metadata
+	partitioned bool        // Whether the tables have non-overlapping key ranges
+	cache       *BlockCache // The tree's block cache, for the tables (may be nil)
+	compactKey  string      // Max key of the last table compacted out of the level
 }
 
 // CreateLevel creates a new level handle for the given level
 // number in the given directory.
-func CreateLevel(n uint16, d string) (*Level, error) {
+//
+// The level's directory and metadata are synced to disk before
+// it returns, so the level can be referenced (e.g. by the tree's
+// manifest) right away. If it fails, the directory is removed.
+func CreateLevel(n uint16, d string) (level *Level, err error) {
 	// Format the level path
 	p := fmtLevelPath(d, n)
 
-	// Make the directory
+	// Make the directory, and clean it up if anything fails
 	if err := os.Mkdir(p, 0755); err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(p)
+		}
+	}()
 
 	// Create the metadata
 	meta := LevelMeta{
-		Level:   n,
-		MinKey:  "",
-		MaxKey:  "",
-		Tables:  []string{},
-		MaxSize: DefaultLevelMaxSize,
+		Level:    n,
+		MinKey:   "",
+		MaxKey:   "",
+		Tables:   []string{},
+		MaxSize:  DefaultLevelMaxSize,
+		MaxBytes: levelMaxBytes(n),
 	}
 
 	// Write the metadata file
-	metaPath := path.Join(p, "_meta.json")
+	metaPath := path.Join(p, LevelMetaFileName)
 	b, err := json.Marshal(meta)
 	if err != nil {
 		return nil, err
 	}
-	if err := os.WriteFile(metaPath, b, 0644); err != nil {
+	if err := writeFileAtomic(metaPath, b); err != nil {
+		return nil, err
+	}
+
+	// Sync the level's directory entry
+	if err := syncDir(d); err != nil {
 		return nil, err
 	}
 
 	// Create the level
-	level := &Level{
-		path:   p,
-		meta:   meta,
-		tables: []*SSTable{},
+	level = &Level{
+		path:        p,
+		meta:        meta,
+		tables:      []*SSTable{},
+		partitioned: n > 1,
 	}
 
 	// Done
 	return level, nil
 }
 
+// LoadLevel loads an existing level, with the level number n,
+// from the given directory.
+//
+// It reads the level's metadata and opens each of its tables, in
+// the order they're listed, validating each table's metadata against
+// its data file. If a listed table is missing, it returns an error
+// wrapping ErrMissingTable. Table directories that exist on disk but
+// aren't listed in the metadata are reported by Orphans.
 func LoadLevel(n uint16, d string) (*Level, error) {
-	return nil, fmt.Errorf("not implemented")
+	return loadLevel(n, d, nil)
 }
 
-// Full checks if the level has the maximum number of tables.
+// loadLevel loads an existing level, like LoadLevel, but if ids
+// isn't nil, it opens the tables in ids (e.g. from the tree's
+// manifest) instead of the ones listed in the level's metadata,
+// and updates the metadata to match.
+func loadLevel(n uint16, d string, ids []string) (*Level, error) {
+	// Format the level path
+	p := fmtLevelPath(d, n)
+
+	// Read the metadata file
+	metaPath := path.Join(p, LevelMetaFileName)
+	b, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read level %d meta file: %w", n, err)
+	}
+	var meta LevelMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal level %d meta file as json: %w", n, err)
+	}
+	if meta.Level != n {
+		return nil, fmt.Errorf("level %d meta file has level %d", n, meta.Level)
+	}
+	if meta.MaxBytes == 0 {
+		// Written before levels had a size limit
+		meta.MaxBytes = levelMaxBytes(n)
+	}
+
+	// Create the level
+	level := &Level{
+		path:        p,
+		meta:        meta,
+		tables:      make([]*SSTable, 0, len(meta.Tables)),
+		partitioned: n > 1,
+	}
+
+	// Find the table directories on disk
+	ents, err := os.ReadDir(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read level %d directory: %w", n, err)
+	}
+	onDisk := make(map[string]bool)
+	for _, e := range ents {
+		if e.IsDir() {
+			onDisk[e.Name()] = true
+		}
+	}
+
+	// Open the tables
+	stale := ids != nil && !slices.Equal(ids, meta.Tables)
+	if ids == nil {
+		ids = meta.Tables
+	}
+	var errs []error
+	for _, id := range ids {
+		if !onDisk[id] {
+			errs = append(errs, fmt.Errorf("level %d table id=%q: %w", n, id, ErrMissingTable))
+			continue
+		}
+		delete(onDisk, id)
+
+		t, err := ReadSSTable(p, id)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		level.tables = append(level.tables, t)
+		if err := t.validate(n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		level.Close()
+		return nil, err
+	}
+
+	// Keep the partitioned levels sorted (the metadata should
+	// already be in order, but don't rely on it)
+	level.sortTables()
+
+	// Anything left over is an orphan
+	for id := range onDisk {
+		level.orphans = append(level.orphans, id)
+	}
+	slices.Sort(level.orphans)
+
+	// Bring the metadata up to date
+	if stale {
+		if err := level.updateMetadata(); err != nil {
+			level.Close()
+			return nil, err
+		}
+	}
+
+	// Done
+	return level, nil
+}
+
+// Orphans returns the ids of table directories found in the
+// level's directory that aren't listed in its metadata (for
+// example, left behind by an interrupted compaction).
+func (l *Level) Orphans() []string {
+	l.RLock()
+	defer l.RUnlock()
+	return slices.Clone(l.orphans)
+}
+
+// levelMaxBytes returns the default maximum total table size
+// for the level n. The first level is limited by its number of
+// tables instead, so it has no byte limit.
+func levelMaxBytes(n uint16) uint64 {
+	if n < 2 {
+		return 0
+	}
+	b := uint64(DefaultLevelBaseBytes)
+	for i := uint16(2); i < n; i++ {
+		b *= DefaultLevelSizeRatio
+	}
+	return b
+}
+
+// removeOrphans deletes the level's orphaned table directories.
+func (l *Level) removeOrphans() error {
+	l.Lock()
+	defer l.Unlock()
+	for _, id := range l.orphans {
+		if err := os.RemoveAll(path.Join(l.path, id)); err != nil {
+			return fmt.Errorf("failed to remove level %d orphaned table id=%q: %w", l.meta.Level, id, err)
+		}
+	}
+	l.orphans = nil
+	return nil
+}
+
+// Number returns the level's number (starting at 1).
+func (l *Level) Number() uint16 {
+	return l.meta.Level
+}
+
+// Tables returns the level's tables -- in the order they were
+// added or, for a partitioned level, in key order.
+func (l *Level) Tables() []*SSTable {
+	l.RLock()
+	defer l.RUnlock()
+	return slices.Clone(l.tables)
+}
+
+// setCache sets the block cache for the level's tables,
+// including the ones added later.
+func (l *Level) setCache(c *BlockCache) {
+	l.Lock()
+	defer l.Unlock()
+	l.cache = c
+	for _, t := range l.tables {
+		t.setCache(c)
+	}
+}
+
+// setPartitioned sets whether the level's tables have
+// non-overlapping key ranges (and sorts them, if they do).
+func (l *Level) setPartitioned(p bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.partitioned = p
+	l.sortTables()
+}
+
+// Full checks if the level needs to be compacted -- if an
+// overlapping level has the maximum number of tables, or if a
+// partitioned level's tables are bigger than its maximum size.
 func (l *Level) Full() bool {
-	return len(l.tables) >= int(l.meta.MaxSize)
+	l.RLock()
+	defer l.RUnlock()
+	if !l.partitioned {
+		return len(l.tables) >= int(l.meta.MaxSize)
+	}
+	return l.size() > l.meta.MaxBytes
 }
 
+// Size returns the total size, in bytes, of the level's tables.
+func (l *Level) Size() uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.size()
+}
+
+func (l *Level) size() uint64 {
+	var n uint64
+	for _, t := range l.tables {
+		n += t.size
+	}
+	return n
+}
+
+// Get returns the newest version (by sequence number) of the
+// key's record in the level, or nil if it isn't found.
+//
+// Note that this includes tombstones. Like SSTable.Get, the
+// record's value is a copy, which the caller can modify.
 func (l *Level) Get(key string) (*Record, error) {
+	l.RLock()
+	defer l.RUnlock()
+
 	// Check if the key is in range
 	if key < l.meta.MinKey || key > l.meta.MaxKey {
 		return nil, nil
 	}
 
-	// Iterate over the tables, in reverse order
-	for i := len(l.tables) - 1; i >= 0; i-- {
-		// Get the table
-		table := l.tables[i]
+	// If the tables don't overlap, binary search for the
+	// only one that could have the key
+	if l.partitioned {
+		i := sort.Search(len(l.tables), func(i int) bool {
+			return l.tables[i].meta.MaxKey >= key
+		})
+		if i == len(l.tables) || l.tables[i].meta.MinKey > key {
+			return nil, nil
+		}
+		return l.tables[i].Get(key)
+	}
 
+	// Otherwise, check each of the tables that might have it
+	var newest *Record
+	for _, table := range l.tables {
 		// Get the record
 		r, err := table.Get(key)
 		if err != nil {
 			return nil, err
 		}
 
-		// If the record is found, return it
-		//
-		// Note that this includes tombstones
-		if r != nil {
-			return r, nil
+		// Keep it if it's the newest so far
+		if r != nil && (newest == nil || r.newer(*newest)) {
+			newest = r
 		}
 	}
-
-	// If the record is not found, return nil
-	return nil, nil
+	return newest, nil
 }
 
-func (l *Level) AddTable(table *SSTable) error {
-	l.Lock()
-	defer l.Unlock()
+// versions returns the key's versions in the level's tables,
+// newest first (including tombstones).
+func (l *Level) versions(key string) ([]Record, error) {
+	l.RLock()
+	defer l.RUnlock()
 
-	// Append the table
-	l.tables = append(l.tables, table)
+	// Check if the key is in range
+	if key < l.meta.MinKey || key > l.meta.MaxKey {
+		return nil, nil
+	}
 
-	// Update the metadata
-	if err := l.updateMetadata(); err != nil {
-		return err
+	// If the tables don't overlap, only one could have it
+	tables := l.tables
+	if l.partitioned {
+		i := sort.Search(len(l.tables), func(i int) bool {
+			return l.tables[i].meta.MaxKey >= key
+		})
+		if i == len(l.tables) || l.tables[i].meta.MinKey > key {
+			return nil, nil
+		}
+		tables = l.tables[i : i+1]
 	}
-	return nil
+	return tableVersions(tables, key, math.MaxUint64)
 }
 
-// Compact merges the data in the tables in the level l, into
-// a single table, and writes it to the next level's directory,
-// at the given path, and returns a handle to the new table.
-func (l *Level) Compact(path string) (*SSTable, []string, error) {
-	l.Lock()
-	defer l.Unlock()
-
-	// Make sure there are tables to compact
-	if len(l.tables) == 0 {
-		return nil, nil, fmt.Errorf("no tables to compact")
+// tableVersions returns the key's versions with a sequence number
+// <= seq in the tables, newest first. Each table holds at most one
+// version of a key.
+func tableVersions(tables []*SSTable, key string, seq uint64) ([]Record, error) {
+	var rs []Record
+	for _, table := range tables {
+		r, err := table.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil && r.Seq <= seq {
+			rs = append(rs, *r)
+		}
 	}
+	slices.SortFunc(rs, func(a, b Record) int {
+		return cmp.Compare(b.Seq, a.Seq)
+	})
+	return rs, nil
+}
 
-	// Get the level's directory
+// maxSeq returns the highest sequence number stored in
+// any of the level's tables.
+func (l *Level) maxSeq() uint64 {
+	l.RLock()
+	defer l.RUnlock()
 
-	// Create a table builder
-	builder := &SSTBuilder{
-		Path:  path,
-		Level: l.meta.Level + 1,
-	}
-	if err := builder.SetUp(); err != nil {
-		return nil, nil, err
+	var s uint64
+	for _, t := range l.tables {
+		s = max(s, t.meta.MaxSeq)
 	}
+	return s
+}
+
+// Len returns the number of tables in the level.
+func (l *Level) Len() int {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.tables)
+}
 
-	// Create iterators for each table
-	itrs := make([]*sstIterator, len(l.tables))
+// pin takes a reference to each of the level's tables (so
+// they aren't deleted while in use) and returns them, oldest
+// first. Each table must be unref'd when it's done with.
+func (l *Level) pin() []*SSTable {
+	l.RLock()
+	defer l.RUnlock()
+
+	tables := make([]*SSTable, len(l.tables))
 	for i, t := range l.tables {
-		itrs[i] = &sstIterator{
-			table: t,
-		}
-		itrs[i].start()
+		t.ref()
+		tables[i] = t
 	}
+	return tables
+}
 
-	// Create a function to check if all iterators are done
-	allDone := func(itrs []*sstIterator) bool {
-		for _, itr := range itrs {
-			if !itr.done {
-				return false
-			}
-		}
-		return true
-	}
-
-	// Merge the tables
-	//
-	// Note: Track the last key so we can skip
-	// duplicates by timestamp
-	var lastk string
-
-	// Loop until all iterators are done
-	for !allDone(itrs) {
-		// Pick the next record from the iterator
-		// - Pick the lowest key
-		// - If the key is equal, the oldest table overwrites (and others are skipped)
-
-		// Start with the first one
-		besti := -1
-		var bestr Record
-		var bestt time.Time
-
-		// Loop through...
-		for i, itr := range itrs {
-			// Is this iterator done?
-			if itr.done {
-				continue
-			}
+// pickCompaction chooses the tables to compact out of the level
+// and returns them, along with their combined key range.
+//
+// Tables that are mostly tombstones are picked first, so the space
+// they (and the records they shadow) take up is reclaimed sooner.
+// Otherwise, from an overlapping level, it takes the oldest table
+// and from a partitioned level, the next table round-robin through
+// the key space.
+//
+// From an overlapping level, it also takes every table that overlaps
+// the first one (widening the range until none are left), so that
+// no older version of a key is left behind.
+func (l *Level) pickCompaction() ([]*SSTable, string, string) {
+	l.Lock()
+	defer l.Unlock()
 
-			// If it's the first one, use it
-			if besti == -1 {
-				besti = i
-				bestr = itr.current
-				bestt = l.tables[i].meta.CreatedAt
-				continue
-			}
+	if len(l.tables) == 0 {
+		return nil, "", ""
+	}
 
-			// Is this one lower?
-			if itr.current.Key < bestr.Key {
-				bestr = itr.current
-				bestt = l.tables[i].meta.CreatedAt
-				besti = i
-				continue
+	// Pick the first table
+	first := l.tombstoneHeavy()
+	switch {
+	case first != nil:
+	case l.partitioned:
+		// Take the next table after the last one compacted
+		first = l.tables[0]
+		for _, c := range l.tables {
+			if c.meta.MinKey > l.compactKey {
+				first = c
+				break
 			}
+		}
+		l.compactKey = first.meta.MaxKey
+	default:
+		// Take the oldest table
+		first = l.tables[0]
+	}
+	if l.partitioned {
+		return []*SSTable{first}, first.meta.MinKey, first.meta.MaxKey
+	}
 
-			// Is this key equal?
-			//
-			// Then the most recent table overwrites the others
-			if itr.current.Key == bestr.Key && l.tables[i].meta.CreatedAt.After(bestt) {
-				bestr = itr.current
-				bestt = l.tables[i].meta.CreatedAt
-				besti = i
+	// Take everything overlapping it
+	picked := map[string]bool{first.id: true}
+	minKey, maxKey := first.meta.MinKey, first.meta.MaxKey
+	for grew := true; grew; {
+		grew = false
+		for _, t := range l.tables {
+			if picked[t.id] || !t.overlaps(minKey, maxKey) {
 				continue
 			}
+			picked[t.id] = true
+			minKey = min(minKey, t.meta.MinKey)
+			maxKey = max(maxKey, t.meta.MaxKey)
+			grew = true
 		}
-
-		// Have we already seen this key?
-		if lastk == bestr.Key {
-			continue
+	}
+	var tables []*SSTable
+	for _, t := range l.tables {
+		if picked[t.id] {
+			tables = append(tables, t)
 		}
+	}
+	return tables, minKey, maxKey
+}
 
-		// Add the record to the builder
-		if err := builder.Add(bestr); err != nil {
-			return nil, nil, err
+// tombstoneHeavy returns the table in the level with the highest
+// ratio of tombstones to records, if it's at least
+// DefaultTombstoneRatio, or nil otherwise.
+func (l *Level) tombstoneHeavy() *SSTable {
+	var heaviest *SSTable
+	for _, t := range l.tables {
+		r := t.meta.tombstoneRatio()
+		if r >= DefaultTombstoneRatio && (heaviest == nil || r > heaviest.meta.tombstoneRatio()) {
+			heaviest = t
 		}
-
-		// Advance the iterator
-		itrs[besti].next()
-
-		// Store the last key that was added
-		lastk = bestr.Key
 	}
+	return heaviest
+}
 
-	// Build the new table
-	t, err := builder.Finish()
-	if err != nil {
-		return nil, nil, err
-	}
+// overlapping returns the level's tables with keys in the
+// range [minKey, maxKey].
+func (l *Level) overlapping(minKey, maxKey string) []*SSTable {
+	l.RLock()
+	defer l.RUnlock()
 
-	// Get a list of the ids of the tables that
-	// were compacted (for cleanup)
-	ids := make([]string, len(l.tables))
-	for i, t := range l.tables {
-		ids[i] = t.meta.ID
+	var tables []*SSTable
+	for _, t := range l.tables {
+		if t.overlaps(minKey, maxKey) {
+			tables = append(tables, t)
+		}
 	}
+	return tables
+}
 
-	// Done!
-	return t, ids, nil
+func (l *Level) AddTable(table *SSTable) error {
+	return l.ReplaceTables([]*SSTable{table}, nil)
 }
 
 func (l *Level) DeleteTables(ids []string) error {
+	return l.ReplaceTables(nil, ids)
+}
+
+// ReplaceTables adds the tables in add to the level and removes
+// the tables with the ids in remove, in a single metadata update.
+//
+// The tables are always swapped in, even if it returns an error --
+// by the time it's called, the change has been logged to the tree's
+// manifest, so readers must see it. Errors are from writing the
+// metadata, or deleting the removed tables' files, which are
+// cleaned up when the tree is next loaded (the metadata is rewritten
+// from the manifest, and leftover tables are removed as orphans).
+//
+// The metadata is written before the removed tables' files are
+// deleted, so a crash in between leaves orphaned directories
+// rather than a level that references missing tables.
+func (l *Level) ReplaceTables(add []*SSTable, remove []string) error {
 	l.Lock()
 	defer l.Unlock()
 
 	// Create a new table list
-	tablesToKeep := make([]*SSTable, 0, len(l.tables))
-	tablesToDelete := make([]*SSTable, 0, len(ids))
+	tablesToKeep := make([]*SSTable, 0, len(l.tables)+len(add))
+	tablesToDelete := make([]*SSTable, 0, len(remove))
 	for _, t := range l.tables {
-		if slices.Contains(ids, t.meta.ID) {
+		if slices.Contains(remove, t.meta.ID) {
 			tablesToDelete = append(tablesToDelete, t)
 			continue
 		}
 		tablesToKeep = append(tablesToKeep, t)
 	}
-
-	// Delete the tables
-	for _, t := range tablesToDelete {
-		if err := t.DeleteTable(); err != nil {
-			return err
-		}
+	for _, t := range add {
+		t.setCache(l.cache)
 	}
+	tablesToKeep = append(tablesToKeep, add...)
 
 	// Update the table handles
 	l.tables = tablesToKeep
+	l.sortTables()
 
 	// Update the metadata
+	var errs []error
 	if err := l.updateMetadata(); err != nil {
-		return err
+		errs = append(errs, err)
+	}
+
+	// Delete the old tables (even if the metadata couldn't be
+	// written, since they're no longer in the level either way)
+	for _, t := range tablesToDelete {
+		if err := t.DeleteTable(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete sst id=%q: %w", t.id, err))
+		}
 	}
 
 	// Done
-	return nil
+	return errors.Join(errs...)
+}
+
+// sortTables sorts a partitioned level's tables by key. An
+// overlapping level's tables stay in the order they were added.
+func (l *Level) sortTables() {
+	if !l.partitioned {
+		return
+	}
+	slices.SortFunc(l.tables, func(a, b *SSTable) int {
+		return strings.Compare(a.meta.MinKey, b.meta.MinKey)
+	})
 }
 
 func (l *Level) updateMetadata() error {
@@ -306,8 +639,8 @@ func (l *Level) updateMetadata() error {
 	}
 
 	// Write the metadata to the file
-	p := path.Join(l.path, "_meta.json")
-	if err := os.WriteFile(p, b, 0644); err != nil {
+	p := path.Join(l.path, LevelMetaFileName)
+	if err := writeFileAtomic(p, b); err != nil {
 		return fmt.Errorf("failed to write metadata to file: %w", err)
 	}
 	return nil
@@ -317,26 +650,26 @@ func (l *Level) Close() error {
 	l.Lock()
 	defer l.Unlock()
 
-	// Close all tables
-	var errs []error
+	// Close all tables (each table's error gets its own slot,
+	// since the tables are closed concurrently)
+	errs := make([]error, len(l.tables))
 	var wg sync.WaitGroup
-	for _, t := range l.tables {
+	for i, t := range l.tables {
 		wg.Add(1)
-		go func(t *SSTable) {
+		go func(i int, t *SSTable) {
 			defer wg.Done()
-			if err := t.Close(); err != nil {
-				errs = append(errs, err)
-			}
-		}(t)
+			errs[i] = t.Close()
+		}(i, t)
 	}
 	wg.Wait()
 	return errors.Join(errs...)
 }
 
 type LevelMeta struct {
-	Level   uint16   `json:"level"`   // Level number (starts with 1; 0 is memtable)
-	MaxSize uint16   `json:"maxSize"` // Max num of tables in this level
-	MinKey  string   `json:"minKey"`  // Minimum key in this level
-	MaxKey  string   `json:"maxKey"`  // Maximum key in this level
-	Tables  []string `json:"tables"`  // IDs of tables in this level
+	Level    uint16   `json:"level"`              // Level number (starts with 1; 0 is memtable)
+	MaxSize  uint16   `json:"maxSize"`            // Max num of tables in this level (first level only)
+	MaxBytes uint64   `json:"maxBytes,omitempty"` // Max total size of the tables in this level (after the first)
+	MinKey   string   `json:"minKey"`             // Minimum key in this level
+	MaxKey   string   `json:"maxKey"`             // Maximum key in this level
+	Tables   []string `json:"tables"`             // IDs of tables in this level
 }
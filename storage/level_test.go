@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadLevel(t *testing.T) {
+	// buildTable writes a small table into the level
+	buildTable := func(t *testing.T, l *Level, keys ...string) *SSTable {
+		builder := &SSTBuilder{
+			Path:  l.path,
+			Level: l.meta.Level,
+		}
+		if err := builder.SetUp(); err != nil {
+			t.Fatalf("failed to set up the builder: %s", err)
+		}
+		for _, k := range keys {
+			if err := builder.Add(Record{Key: k}); err != nil {
+				t.Fatalf("failed to add record: %s", err)
+			}
+		}
+		table, err := builder.Finish()
+		if err != nil {
+			t.Fatalf("failed to finish the builder: %s", err)
+		}
+		return table
+	}
+
+	t.Run("should load the tables listed in the metadata", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "level")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		level, err := CreateLevel(1, d)
+		if err != nil {
+			t.Fatalf("failed to create level: %s", err)
+		}
+		t1 := buildTable(t, level, "a", "c")
+		t2 := buildTable(t, level, "b", "d")
+		for _, table := range []*SSTable{t1, t2} {
+			if err := level.AddTable(table); err != nil {
+				t.Fatalf("failed to add table: %s", err)
+			}
+		}
+
+		// Leave an orphaned table behind
+		orphan := buildTable(t, level, "x")
+		orphan.Close()
+
+		if err := level.Close(); err != nil {
+			t.Fatalf("failed to close level: %s", err)
+		}
+
+		level, err = LoadLevel(1, d)
+		if err != nil {
+			t.Fatalf("failed to load level: %s", err)
+		}
+		defer level.Close()
+
+		if len(level.tables) != 2 || level.tables[0].id != t1.id || level.tables[1].id != t2.id {
+			t.Fatalf("expected tables [%s %s] in order", t1.id, t2.id)
+		}
+		if orphans := level.Orphans(); len(orphans) != 1 || orphans[0] != orphan.id {
+			t.Fatalf("expected orphans [%s], got %v", orphan.id, orphans)
+		}
+		for _, k := range []string{"a", "b", "c", "d"} {
+			if r, err := level.Get(k); err != nil || r == nil {
+				t.Fatalf("expected key %q to be found (err=%v)", k, err)
+			}
+		}
+	})
+
+	t.Run("should report missing tables", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "level")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		level, err := CreateLevel(1, d)
+		if err != nil {
+			t.Fatalf("failed to create level: %s", err)
+		}
+		table := buildTable(t, level, "a")
+		if err := level.AddTable(table); err != nil {
+			t.Fatalf("failed to add table: %s", err)
+		}
+		if err := level.Close(); err != nil {
+			t.Fatalf("failed to close level: %s", err)
+		}
+		if err := os.RemoveAll(path.Join(level.path, table.id)); err != nil {
+			t.Fatalf("failed to remove table: %s", err)
+		}
+
+		if _, err := LoadLevel(1, d); !errors.Is(err, ErrMissingTable) {
+			t.Fatalf("expected ErrMissingTable, got %v", err)
+		}
+	})
+}
+
+func TestLevel_Compact(t *testing.T) {
+	t.Run("should merge tables with the newest version winning", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "level")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		l1, err := CreateLevel(1, d)
+		if err != nil {
+			t.Fatalf("failed to create level: %s", err)
+		}
+		defer l1.Close()
+		l2, err := CreateLevel(2, d)
+		if err != nil {
+			t.Fatalf("failed to create level: %s", err)
+		}
+		defer l2.Close()
+
+		// Add a third level, so the second isn't the bottommost
+		// (where the tombstone would be dropped)
+		l3, err := CreateLevel(3, d)
+		if err != nil {
+			t.Fatalf("failed to create level: %s", err)
+		}
+		defer l3.Close()
+
+		// Add the tables, oldest first
+		tables := [][]Record{
+			{{Key: "a", Seq: 1, Value: map[string]any{"v": 1.0}}, {Key: "b", Seq: 2, Value: map[string]any{"v": 1.0}}},
+			{{Key: "a", Seq: 3, Value: map[string]any{"v": 2.0}}, {Key: "c", Seq: 4, Value: map[string]any{"v": 2.0}}},
+			{{Key: "a", Seq: 5, Value: map[string]any{"v": 3.0}}, {Key: "b", Seq: 6, Tomb: true}},
+		}
+		for _, records := range tables {
+			builder := &SSTBuilder{Path: l1.path, Level: 1}
+			if err := builder.SetUp(); err != nil {
+				t.Fatalf("failed to set up the builder: %s", err)
+			}
+			for _, r := range records {
+				if err := builder.Add(r); err != nil {
+					t.Fatalf("failed to add record: %s", err)
+				}
+			}
+			table, err := builder.Finish()
+			if err != nil {
+				t.Fatalf("failed to finish the builder: %s", err)
+			}
+			if err := l1.AddTable(table); err != nil {
+				t.Fatalf("failed to add table: %s", err)
+			}
+		}
+
+		tree := newLevelTestTree(t, d, DefaultTargetTableSize, l1, l2, l3)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if l1.Len() != 0 {
+			t.Fatalf("expected the first level to be empty, got %d tables", l1.Len())
+		}
+		if l2.Len() != 1 {
+			t.Fatalf("expected 1 table in the second level, got %d", l2.Len())
+		}
+		table := l2.tables[0]
+
+		var got []Record
+		if err := table.scan(func(r Record) (bool, error) {
+			got = append(got, r)
+			return false, nil
+		}); err != nil {
+			t.Fatalf("failed to scan: %s", err)
+		}
+		if len(got) != 3 {
+			t.Fatalf("expected 3 records, got %+v", got)
+		}
+		if got[0].Key != "a" || got[0].Value["v"] != 3.0 {
+			t.Fatalf("expected newest version of key %q, got %+v", "a", got[0])
+		}
+		if got[1].Key != "b" || !got[1].Tomb {
+			t.Fatalf("expected tombstone for key %q, got %+v", "b", got[1])
+		}
+		if got[2].Key != "c" || got[2].Value["v"] != 2.0 {
+			t.Fatalf("expected key %q, got %+v", "c", got[2])
+		}
+	})
+
+	t.Run("should split lower levels into non-overlapping tables", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "level")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		var levels []*Level
+		for n := uint16(1); n <= 3; n++ {
+			l, err := CreateLevel(n, d)
+			if err != nil {
+				t.Fatalf("failed to create level: %s", err)
+			}
+			defer l.Close()
+			levels = append(levels, l)
+		}
+		l1, l2, l3 := levels[0], levels[1], levels[2]
+
+		// Add a table with 100 keys to the first level
+		builder := &SSTBuilder{Path: l1.path, Level: 1, BlockSize: 64}
+		if err := builder.SetUp(); err != nil {
+			t.Fatalf("failed to set up the builder: %s", err)
+		}
+		for i := 0; i < 100; i++ {
+			r := Record{Key: fmt.Sprintf("key-%03d", i), Seq: uint64(i + 1), Value: map[string]any{"v": float64(i)}}
+			if err := builder.Add(r); err != nil {
+				t.Fatalf("failed to add record: %s", err)
+			}
+		}
+		table, err := builder.Finish()
+		if err != nil {
+			t.Fatalf("failed to finish the builder: %s", err)
+		}
+		if err := l1.AddTable(table); err != nil {
+			t.Fatalf("failed to add table: %s", err)
+		}
+
+		// Compact it down, with a small target table size
+		tree := newLevelTestTree(t, d, 512, levels...)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if l2.Len() < 2 {
+			t.Fatalf("expected the second level to be split into several tables, got %d", l2.Len())
+		}
+		for i := 1; i < len(l2.tables); i++ {
+			if l2.tables[i-1].meta.MaxKey >= l2.tables[i].meta.MinKey {
+				t.Fatalf("expected non-overlapping tables, got %+v and %+v", l2.tables[i-1].meta, l2.tables[i].meta)
+			}
+		}
+
+		// Every key should be found (by binary search)
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("key-%03d", i)
+			r, err := l2.Get(k)
+			if err != nil {
+				t.Fatalf("failed to get key %q: %s", k, err)
+			}
+			if r == nil || r.Value["v"] != float64(i) {
+				t.Fatalf("expected key %q to have v=%d, got %+v", k, i, r)
+			}
+		}
+		if r, err := l2.Get("key-0505"); err != nil || r != nil {
+			t.Fatalf("expected missing key, got %+v (err=%v)", r, err)
+		}
+
+		// Compacting the second level should only move one table
+		n := l2.Len()
+		if err := tree.compactLevel(1, 2); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if l2.Len() != n-1 || l3.Len() != 1 {
+			t.Fatalf("expected one table to move down, got %d and %d tables", l2.Len(), l3.Len())
+		}
+	})
+}
+
+func TestLevel_pickCompaction(t *testing.T) {
+	t.Run("should pick tables with a high tombstone ratio first", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "level")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		l, err := CreateLevel(2, d)
+		if err != nil {
+			t.Fatalf("failed to create level: %s", err)
+		}
+		defer l.Close()
+
+		// Add a table of values, then a table of mostly tombstones
+		tables := [][]Record{
+			{{Key: "a", Seq: 1, Value: map[string]any{}}, {Key: "b", Seq: 2, Value: map[string]any{}}},
+			{{Key: "c", Seq: 3, Tomb: true}, {Key: "d", Seq: 4, Tomb: true}, {Key: "e", Seq: 5, Value: map[string]any{}}},
+		}
+		for _, records := range tables {
+			builder := &SSTBuilder{Path: l.path, Level: 2}
+			if err := builder.SetUp(); err != nil {
+				t.Fatalf("failed to set up the builder: %s", err)
+			}
+			for _, r := range records {
+				if err := builder.Add(r); err != nil {
+					t.Fatalf("failed to add record: %s", err)
+				}
+			}
+			table, err := builder.Finish()
+			if err != nil {
+				t.Fatalf("failed to finish the builder: %s", err)
+			}
+			if err := l.AddTable(table); err != nil {
+				t.Fatalf("failed to add table: %s", err)
+			}
+		}
+
+		picked, minKey, maxKey := l.pickCompaction()
+		if len(picked) != 1 || minKey != "c" || maxKey != "e" {
+			t.Fatalf("expected the tombstone-heavy table to be picked, got %d tables in [%q, %q]", len(picked), minKey, maxKey)
+		}
+	})
+}
+
+// newLevelTestTree returns a bare tree over the levels (in the
+// directory d), so compactions between them can be tested.
+func newLevelTestTree(t *testing.T, d string, tableSize uint64, levels ...*Level) *LSMTree {
+	t.Helper()
+	tree := &LSMTree{
+		path:      d,
+		levels:    levels,
+		tableSize: tableSize,
+		strategy:  LeveledCompaction{},
+	}
+	m, err := createManifest(d, tree.version())
+	if err != nil {
+		t.Fatalf("failed to create manifest: %s", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	tree.manifest = m
+	return tree
+}
@@ -1,220 +1,820 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"os"
 	"path"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	TreeMetaFileName = "_meta.json"
+	LevelsDirName    = "levels"
+)
+
+// ErrEmptyKey is returned when writing a record with an empty
+// key, which tables can't store.
+var ErrEmptyKey = errors.New("key is empty")
+
 type LSMTree struct {
 	sync.RWMutex
 	path           string    // That path to the tree's directory
 	memtable       *Memtable // The current active memtable
 	frozenMemtable *Memtable // A memtable being compacted
 	levels         []*Level  // Handles to the levels
+	manifest       *manifest // Log of the changes to the levels' tables
+	meta           LSMTreeMeta
+	seq            atomic.Uint64      // The last sequence number assigned to a write
+	flushedSeq     uint64             // The last sequence number flushed from a memtable to a table
+	compactor      *compactor         // Runs flushes and compactions in the background
+	flushMu        sync.Mutex         // Serializes memtable flushes
+	tableSize      uint64             // Target size of the tables written by level compactions
+	strategy       CompactionStrategy // Decides when and how levels are compacted
+	compression    string             // Name of the compressor for new tables
+	bloomBits      int                // Bloom filter bits per key for new tables
+	prefixLength   int                // Length of the prefixes in new tables' prefix bloom filters
+	cache          *BlockCache        // Decoded blocks, shared by all the levels (may be nil)
+	merge          MergeOperator      // Folds merge records into values (nil if the tree doesn't have one)
+	snapMu         sync.Mutex         // Guards snapshots
+	snapshots      map[uint64]int     // Number of live snapshots at each sequence number
 }
 
 type NewLSMTreeConf struct {
-	Path string // The path to the tree's directory
+	Path               string             // The path to the tree's directory
+	CompactionWorkers  int                // Number of background compaction workers (0 uses DefaultCompactionWorkers, <0 disables them)
+	CompactionStrategy CompactionStrategy // How the tree's levels are compacted (nil uses LeveledCompaction)
+	Compression        string             // Name of the compressor for new tables' data blocks (defaults to NoCompression)
+	BlockCacheSize     int64              // Capacity of the block cache, in bytes (0 uses DefaultBlockCacheSize, <0 disables it)
+	BloomBitsPerKey    int                // Bloom filter bits per key for new tables (defaults to DefaultBloomBitsPerKey)
+	PrefixBloomLength  int                // Length of the key prefixes in new tables' prefix bloom filters (0 means no prefix filters)
+	MergeOperator      string             // Name of the tree's merge operator, for LSMTree.Merge (empty means none)
 }
 
+// NewLSMTree creates a new, empty tree in the directory at
+// conf.Path. It creates the directory (if it doesn't already
+// exist), the tree's metadata file, and the WAL and level
+// directories.
+//
+// It returns an error if a tree already exists at that path.
 func NewLSMTree(conf NewLSMTreeConf) (*LSMTree, error) {
-	return nil, fmt.Errorf("not implemented")
+	// Make sure there isn't already a tree here
+	mp := path.Join(conf.Path, TreeMetaFileName)
+	if _, err := os.Stat(mp); err == nil {
+		return nil, fmt.Errorf("tree already exists at %q", conf.Path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// Make sure the compressor and merge operator exist
+	if _, err := getCompressor(conf.Compression); err != nil {
+		return nil, err
+	}
+	merge, err := getMergeOperator(conf.MergeOperator)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the directories
+	if err := os.MkdirAll(conf.Path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tree directory: %w", err)
+	}
+	strategy := conf.CompactionStrategy
+	if strategy == nil {
+		strategy = LeveledCompaction{}
+	}
+	t := &LSMTree{
+		path:   conf.Path,
+		levels: []*Level{},
+		meta: LSMTreeMeta{
+			CreatedAt:     time.Now(),
+			Levels:        0,
+			Compaction:    strategy.Name(),
+			MergeOperator: conf.MergeOperator,
+		},
+		strategy: strategy,
+		merge:    merge,
+	}
+	t.compactor = newCompactor(t, conf.CompactionWorkers)
+	t.tableSize = DefaultTargetTableSize
+	t.compression = conf.Compression
+	t.bloomBits = conf.BloomBitsPerKey
+	t.prefixLength = conf.PrefixBloomLength
+	t.cache = newTreeBlockCache(conf.BlockCacheSize)
+	if err := os.Mkdir(t.walDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+	if err := os.Mkdir(t.levelDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create levels directory: %w", err)
+	}
+
+	// Create the first WAL and the memtable
+	wal, err := t.nextWAL()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wal: %w", err)
+	}
+	t.memtable = NewMemtable(wal, &t.seq)
+
+	// Create the (empty) manifest
+	t.manifest, err = createManifest(t.path, t.version())
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the metadata last, so a half-created
+	// tree isn't mistaken for a real one
+	if err := t.writeMeta(); err != nil {
+		return nil, err
+	}
+
+	// Start the background compactions
+	t.compactor.start()
+
+	// Done
+	return t, nil
 }
 
 type LoadLSMTreeConf struct {
-	Path string // The path to the tree's directory
+	Path               string             // The path to the tree's directory
+	CompactionWorkers  int                // Number of background compaction workers (0 uses DefaultCompactionWorkers, <0 disables them)
+	CompactionStrategy CompactionStrategy // How the tree's levels are compacted (nil uses the built-in strategy the tree was created with)
+	Compression        string             // Name of the compressor for new tables' data blocks (defaults to NoCompression)
+	BlockCacheSize     int64              // Capacity of the block cache, in bytes (0 uses DefaultBlockCacheSize, <0 disables it)
+	BloomBitsPerKey    int                // Bloom filter bits per key for new tables (defaults to DefaultBloomBitsPerKey)
+	PrefixBloomLength  int                // Length of the key prefixes in new tables' prefix bloom filters (0 means no prefix filters)
+	MergeOperator      string             // Name of the tree's merge operator (empty uses the one the tree was created with)
 }
 
+// LoadLSMTree opens an existing tree in the directory at
+// conf.Path.
+//
+// It reads the tree's metadata, loads each of its levels, and
+// replays its WALs to rebuild the memtable (and the frozen
+// memtable, if one was waiting to be flushed).
 func LoadLSMTree(conf LoadLSMTreeConf) (*LSMTree, error) {
-	return nil, fmt.Errorf("not implemented")
-}
+	// Make sure the compressor exists
+	if _, err := getCompressor(conf.Compression); err != nil {
+		return nil, err
+	}
 
-func (t *LSMTree) Get(k string) (map[string]any, error) {
-	t.RLock()
-	defer t.RUnlock()
+	// Read the metadata
+	mp := path.Join(conf.Path, TreeMetaFileName)
+	b, err := os.ReadFile(mp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree meta file: %w", err)
+	}
+	var meta LSMTreeMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tree meta file as json: %w", err)
+	}
 
-	// Check the memtable first
-	r, err := t.memtable.Get(k)
+	// Get the compaction strategy the tree was created with
+	strategy := conf.CompactionStrategy
+	if strategy == nil {
+		strategy, err = compactionStrategy(meta.Compaction)
+		if err != nil {
+			return nil, err
+		}
+	} else if meta.Compaction != "" && strategy.Name() != meta.Compaction {
+		return nil, fmt.Errorf("tree was created with compaction strategy %q, not %q", meta.Compaction, strategy.Name())
+	}
+
+	// Get its merge operator (a tree without one can be given one,
+	// but one can't be swapped for another, since the tree may hold
+	// merge records that only it knows how to fold)
+	mergeName := meta.MergeOperator
+	if conf.MergeOperator != "" {
+		if mergeName != "" && mergeName != conf.MergeOperator {
+			return nil, fmt.Errorf("tree was created with merge operator %q, not %q", mergeName, conf.MergeOperator)
+		}
+		mergeName = conf.MergeOperator
+	}
+	merge, err := getMergeOperator(mergeName)
 	if err != nil {
 		return nil, err
 	}
-	if r != nil {
-		return r.Value, nil
+
+	t := &LSMTree{
+		path:     conf.Path,
+		levels:   make([]*Level, 0, meta.Levels),
+		meta:     meta,
+		strategy: strategy,
+		merge:    merge,
+	}
+	t.meta.MergeOperator = mergeName
+	t.compactor = newCompactor(t, conf.CompactionWorkers)
+	t.tableSize = DefaultTargetTableSize
+	t.compression = conf.Compression
+	t.bloomBits = conf.BloomBitsPerKey
+	t.prefixLength = conf.PrefixBloomLength
+	t.cache = newTreeBlockCache(conf.BlockCacheSize)
+
+	// Replay the manifest, to find the live tables (trees created
+	// before there was a manifest use the levels' metadata instead)
+	//
+	// If it ended with a torn edit, the tables and levels that edit
+	// would have added are left on disk rather than cleaned up, in
+	// case the edit was more than just torn
+	man, v, err := openManifest(t.path)
+	cleanup := true
+	if errors.Is(err, os.ErrNotExist) {
+		v = nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		man.Close()
+		t.meta.Levels = uint16(len(v.levels))
+		cleanup = !man.torn
+		t.seq.Store(v.lastSeq)
+		t.flushedSeq = v.flushedSeq
 	}
 
-	// Check the frozen memtable (if it exists)
-	if t.frozenMemtable != nil {
-		r, err := t.frozenMemtable.Get(k)
+	// Load the levels
+	var maxSeq uint64 // The highest sequence number in the tables
+	for n := uint16(1); n <= t.meta.Levels; n++ {
+		var ids []string
+		if v != nil {
+			ids = slices.Concat([]string{}, v.levels[n-1])
+		}
+		level, err := loadLevel(n, t.levelDir(), ids)
 		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to load level %d: %w", n, err)
+		}
+		level.setPartitioned(strategy.Partitioned(n))
+		level.setCache(t.cache)
+		t.levels = append(t.levels, level)
+
+		// Pick up where the sequence numbers left off
+		maxSeq = max(maxSeq, level.maxSeq())
+		if maxSeq > t.seq.Load() {
+			t.seq.Store(maxSeq)
+		}
+
+		// Clean up tables left behind by a crash
+		if !cleanup {
+			continue
+		}
+		if err := level.removeOrphans(); err != nil {
+			t.Close()
 			return nil, err
 		}
-		if r != nil {
-			return r.Value, nil
+	}
+	if cleanup {
+		if err := t.removeExtraLevels(); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	if t.meta != meta {
+		if err := t.writeMeta(); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+
+	// Trees that haven't logged a flush since the manifest started
+	// recording them fall back to the tables' highest sequence number
+	if t.flushedSeq == 0 {
+		t.flushedSeq = maxSeq
+	}
+
+	// Start a fresh manifest, with the current version
+	t.manifest, err = createManifest(t.path, t.version())
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	// Replay the WALs
+	if err := t.loadMemtables(t.flushedSeq); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	// Start the background compactions
+	t.compactor.start()
+
+	// Done
+	return t, nil
+}
+
+// loadMemtables rebuilds the memtables from the WAL files on disk.
+//
+// The newest WAL backs the active memtable. If there is an older
+// one, it belonged to a memtable that was frozen but not yet flushed,
+// so it's restored as the frozen memtable.
+//
+// Records with a sequence number <= flushed are already in the
+// tables, so they're skipped. (A crash after a flush, but before
+// the frozen memtable's WAL was deleted, leaves both behind, and
+// merge records mustn't be applied twice.) The flushed sequence
+// number comes from the manifest, rather than the tables, since
+// compaction may have dropped the newest flushed records.
+func (t *LSMTree) loadMemtables(flushed uint64) error {
+	ids, err := ListWALs(t.walDir())
+	if err != nil {
+		return fmt.Errorf("failed to list wals: %w", err)
+	}
+
+	switch len(ids) {
+	case 0:
+		// No WAL yet, start a fresh one
+		wal, err := t.nextWAL()
+		if err != nil {
+			return fmt.Errorf("failed to create wal: %w", err)
+		}
+		t.memtable = NewMemtable(wal, &t.seq)
+		return nil
+
+	case 1, 2:
+		// Load the frozen memtable, if there is one
+		if len(ids) == 2 {
+			m, err := t.loadMemtable(ids[0], flushed)
+			if err != nil {
+				return err
+			}
+			m.Freeze()
+			t.frozenMemtable = m
+		}
+
+		// Load the active memtable
+		m, err := t.loadMemtable(ids[len(ids)-1], flushed)
+		if err != nil {
+			return err
 		}
+		t.memtable = m
+		return nil
+
+	default:
+		return fmt.Errorf("expected at most 2 wals, found %d", len(ids))
+	}
+}
+
+func (t *LSMTree) loadMemtable(id, flushed uint64) (*Memtable, error) {
+	wal, err := OpenWAL(t.walDir(), id)
+	if err != nil {
+		return nil, err
+	}
+	m, err := replayMemtable(wal, &t.seq, flushed)
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (t *LSMTree) Get(k string) (map[string]any, error) {
+	t.RLock()
+	defer t.RUnlock()
+	r, err := t.resolve(k, t.memtable.versions(k, math.MaxUint64))
+	if err != nil || r == nil {
+		return nil, err
 	}
+	return cloneValue(liveValue(r)), nil
+}
+
+// GetVersion returns the value of the key, like Get, along with
+// its version -- the sequence number of its latest write, which
+// can be passed to CompareAndSwap or DeleteIfVersion. Keys that
+// don't exist (or were deleted, or have expired) are at version 0.
+func (t *LSMTree) GetVersion(k string) (map[string]any, uint64, error) {
+	t.RLock()
+	defer t.RUnlock()
+	r, err := t.resolve(k, t.memtable.versions(k, math.MaxUint64))
+	if err != nil || r == nil || !r.live() {
+		return nil, 0, err
+	}
+	return cloneValue(r.Value), r.Seq, nil
+}
 
-	// Check the levels
+// resolve returns the newest version of the key's record (with
+// any merge records folded into it), given its versions in the
+// active memtable, or nil if there isn't one. Tombstones are
+// included.
+//
+// The caller must hold the tree's read lock.
+func (t *LSMTree) resolve(k string, c versionChain) (*Record, error) {
+	// Check the frozen memtable (if it exists), collecting
+	// versions until there's one that isn't a merge record
+	if !c.complete() && t.frozenMemtable != nil {
+		c.add(t.frozenMemtable.versions(k, math.MaxUint64)...)
+	}
+
+	// Then check the levels
 	for _, level := range t.levels {
-		r, err := level.Get(k)
+		if c.complete() {
+			break
+		}
+		rs, err := level.versions(k)
 		if err != nil {
 			return nil, err
 		}
-		if r != nil {
-			return r.Value, nil
-		}
+		c.add(rs...)
+	}
+
+	// Not found?
+	if len(c) == 0 {
+		return nil, nil
+	}
+
+	// Fold any merge records into the value
+	r, err := c.fold(t.merge, true)
+	if err != nil {
+		return nil, err
 	}
+	return &r, nil
+}
+
+// liveValue returns the record's value, or nil if it's
+// a tombstone or has expired.
+func liveValue(r *Record) map[string]any {
+	if !r.live() {
+		return nil
+	}
+	return r.Value
+}
+
+// Scan returns an iterator over the live keys in the half-open
+// range [start, end), in ascending key order. An empty end means
+// the range has no upper bound, so Scan("", "") iterates over
+// every key in the tree.
+//
+// It merges the memtables and every level's tables, so that only
+// the newest version of each key is returned and deleted keys
+// are skipped. The iterator reads from its own snapshot of the
+// tree, which is released when the iterator is closed.
+func (t *LSMTree) Scan(start, end string) Iterator {
+	snap := t.Snapshot()
+	it := snap.Scan(start, end).(*treeIterator)
+	it.snap = snap
+	return it
+}
 
-	// Not found
-	return nil, nil
+// ScanPrefix returns an iterator over the live keys that start
+// with prefix, like Scan. Tables whose prefix bloom filters (see
+// LoadLSMTreeConf.PrefixBloomLength) rule out the prefix are
+// skipped.
+func (t *LSMTree) ScanPrefix(prefix string) Iterator {
+	snap := t.Snapshot()
+	it := snap.ScanPrefix(prefix).(*treeIterator)
+	it.snap = snap
+	return it
 }
 
 func (t *LSMTree) Put(k string, v map[string]any) error {
+	if err := checkKey(k); err != nil {
+		return err
+	}
+	t.RLock()
+	defer t.RUnlock()
+	defer t.maybeFlush()
 	return t.memtable.Put(Record{
 		Key:   k,
 		Value: v,
 	})
 }
 
+// PutWithTTL sets the value of the key k to v, like Put, but
+// the value expires once ttl has passed. After that, reads treat
+// the key as missing, and compaction removes it.
+func (t *LSMTree) PutWithTTL(k string, v map[string]any, ttl time.Duration) error {
+	if err := checkKey(k); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl %s for key %q: must be positive", ttl, k)
+	}
+	t.RLock()
+	defer t.RUnlock()
+	defer t.maybeFlush()
+	return t.memtable.Put(Record{
+		Key:     k,
+		Expires: time.Now().Add(ttl).UnixNano(),
+		Value:   v,
+	})
+}
+
 func (t *LSMTree) Del(k string) error {
+	if err := checkKey(k); err != nil {
+		return err
+	}
+	t.RLock()
+	defer t.RUnlock()
+	defer t.maybeFlush()
 	return t.memtable.Del(k)
 }
 
+// Merge writes a merge operand for the key k, which the tree's
+// merge operator (see NewLSMTreeConf.MergeOperator) folds into the
+// key's value. It returns an error if the tree doesn't have one.
+//
+// The operand is stored as a merge record, without reading the
+// current value -- it's only applied when the key is read, or
+// when compaction brings it together with the value.
+func (t *LSMTree) Merge(k string, operand map[string]any) error {
+	if err := checkKey(k); err != nil {
+		return err
+	}
+	if t.merge == nil {
+		return fmt.Errorf("can't merge key %q: the tree doesn't have a merge operator", k)
+	}
+
+	// Make sure the operator accepts the operand, so a bad one
+	// doesn't break reads of the key later on
+	if _, err := t.merge.Merge(nil, operand); err != nil {
+		return fmt.Errorf("invalid merge operand for key %q: %w", k, err)
+	}
+
+	t.RLock()
+	defer t.RUnlock()
+	defer t.maybeFlush()
+	return t.memtable.Put(Record{
+		Key:   k,
+		Merge: true,
+		Value: operand,
+	})
+}
+
+// checkKey returns ErrEmptyKey if the key k can't be written.
+func checkKey(k string) error {
+	if k == "" {
+		return ErrEmptyKey
+	}
+	return nil
+}
+
+// maybeFlush schedules a background flush if the memtable is
+// full. The caller must hold the tree's read lock.
+func (t *LSMTree) maybeFlush() {
+	if t.memtable.Full() {
+		t.compactor.schedule()
+	}
+}
+
+// versionLocked returns the key's version (see GetVersion), or
+// 0 if it doesn't exist, or was deleted, or has expired.
+//
+// The caller must hold the tree's read lock and the active
+// memtable's write lock (e.g. from inside Memtable.writeIf).
+func (t *LSMTree) versionLocked(k string) (uint64, error) {
+	r, err := t.resolve(k, t.memtable.versionsLocked(k, math.MaxUint64))
+	if err != nil || r == nil || !r.live() {
+		return 0, err
+	}
+	return r.Seq, nil
+}
+
+// Write applies the batch's puts and deletes atomically.
+func (t *LSMTree) Write(b *WriteBatch) error {
+	for _, r := range b.records {
+		if err := checkKey(r.Key); err != nil {
+			return err
+		}
+	}
+	t.RLock()
+	defer t.RUnlock()
+	defer t.maybeFlush()
+	return t.memtable.Write(b)
+}
+
+// Close stops the background compactions (waiting for any
+// running jobs to finish) and closes the tree's tables and WALs.
+//
+// Any errors from background compactions are returned too.
 func (t *LSMTree) Close() error {
+	// Stop the compactions first, since they need the tree lock,
+	// and collect their errors (the compactor's lock can't be taken
+	// while holding the tree's, since pick takes them the other way
+	// around)
+	var errs []error
+	if t.compactor != nil {
+		t.compactor.stop()
+		errs = append(errs, t.compactor.err())
+	}
+
 	t.Lock()
 	defer t.Unlock()
 
-	// Close all tables
-	var errs []error
+	// Close all tables (each level's error gets its own slot,
+	// since the levels are closed concurrently)
+	levelErrs := make([]error, len(t.levels))
 	var wg sync.WaitGroup
-	for _, l := range t.levels {
+	for i, l := range t.levels {
 		wg.Add(1)
-		go func(l *Level) {
+		go func(i int, l *Level) {
 			defer wg.Done()
-			if err := l.Close(); err != nil {
-				errs = append(errs, err)
-			}
-		}(l)
+			levelErrs[i] = l.Close()
+		}(i, l)
 	}
 	wg.Wait()
-	return errors.Join(errs...)
-}
+	errs = append(errs, levelErrs...)
 
-func (t *LSMTree) Compact() error {
-	// Is the last level full? Or are there no levels yet?
-	// ...then add a new level at the end
-	if len(t.levels) == 0 || t.lastLevelIsFull() {
-		if err := t.addLevel(); err != nil {
-			return fmt.Errorf("failed to add level: %w", err)
+	// Close the manifest
+	if t.manifest != nil {
+		if err := t.manifest.Close(); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	// Iterate in reverse order, compacting each level
-	//
-	// Note that we don't need to compact the last level
-	// because it's either not full or new (and empty)
-	for i := len(t.levels) - 2; i >= 0; i-- {
-		level := t.levels[i]
-
-		// Is this level full?
-		if !level.Full() {
+	// Close the WALs (but keep them on disk)
+	for _, m := range []*Memtable{t.memtable, t.frozenMemtable} {
+		if m == nil || m.wal == nil {
 			continue
 		}
-
-		// Compact the level
-		nextLevelPath := fmtLevelPath(t.levelDir(), uint16(i+1))
-		table, ids, err := level.Compact(nextLevelPath)
-		if err != nil {
-			return fmt.Errorf("failed to compact level %d: %w", i+1, err)
+		if err := m.wal.Close(); err != nil {
+			errs = append(errs, err)
 		}
+	}
+	return errors.Join(errs...)
+}
 
-		// Add the new table to the next level
-		nextLevel := t.levels[i+1]
-		if err := nextLevel.AddTable(table); err != nil {
-			return fmt.Errorf("failed to add compacted table from level %d to level %d: %w", i+1, i+2, err)
-		}
+// CompactionErr returns the errors from background flushes and
+// compactions so far, if there have been any.
+func (t *LSMTree) CompactionErr() error {
+	return t.compactor.err()
+}
 
-		// Delete the old tables
-		if err := level.DeleteTables(ids); err != nil {
-			return fmt.Errorf("failed to delete old tables from level %d: %w", i+1, err)
-		}
-	}
+// Compact runs any pending memtable flush and level compactions
+// on the caller's goroutine, returning the first error. Work that
+// a background worker is already doing is skipped.
+func (t *LSMTree) Compact() error {
+	return t.compactor.runAll()
+}
 
-	// Now check if the memtable is full
-	if !t.memtable.Full() {
-		// If it isn't stop early
-		return nil
-	}
+// Flush flushes the active memtable (and the frozen memtable,
+// if there is one) to a new table in the first level, on the
+// caller's goroutine.
+func (t *LSMTree) Flush() error {
+	return t.flush()
+}
 
-	// If it is, compact it
+// flush makes sure the first level exists, then flushes the
+// memtable into it.
+func (t *LSMTree) flush() error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
 
-	table, err := t.compactMemtable()
-	if err != nil {
-		return fmt.Errorf("failed to compact memtable: %w", err)
+	t.Lock()
+	if len(t.levels) == 0 {
+		if err := t.addLevel(); err != nil {
+			t.Unlock()
+			return fmt.Errorf("failed to add level: %w", err)
+		}
 	}
+	t.Unlock()
 
-	// Add the new table to the first level
-	level := t.levels[0]
-	if err := level.AddTable(table); err != nil {
-		return fmt.Errorf("failed to add compacted table from memtable to level 1: %w", err)
+	if err := t.compactMemtable(); err != nil {
+		return fmt.Errorf("failed to compact memtable: %w", err)
 	}
-
-	// Done
 	return nil
 }
 
-func (t *LSMTree) compactMemtable() (*SSTable, error) {
-	// Create a new memtable
-	mt := NewMemtable()
-
+// compactMemtable freezes the active memtable (unless there's
+// already a frozen one), swaps in a new one, and flushes the
+// frozen memtable to a new table in the first level.
+//
+// The frozen memtable's WAL is only deleted once the new table
+// is durable and has been added to the level.
+func (t *LSMTree) compactMemtable() error {
 	// Lock the tree
 	t.Lock()
 
-	// Freeze the current memtable
-	t.memtable.Freeze()
+	// Nothing to do?
+	if t.frozenMemtable == nil && t.memtable.Len() == 0 {
+		t.Unlock()
+		return nil
+	}
+
+	// Swap in a new memtable, if there isn't a frozen one already
+	if t.frozenMemtable == nil {
+		// Create a new memtable, backed by a new WAL
+		wal, err := t.nextWAL()
+		if err != nil {
+			t.Unlock()
+			return fmt.Errorf("failed to create wal: %w", err)
+		}
+		mt := NewMemtable(wal, &t.seq)
+
+		// Freeze the current memtable
+		t.memtable.Freeze()
 
-	// Swap the memtables
-	t.frozenMemtable = t.memtable
-	t.memtable = mt
+		// Swap the memtables
+		t.frozenMemtable = t.memtable
+		t.memtable = mt
+	}
+	frozen := t.frozenMemtable
+	level := t.levels[0]
 
 	// Unlock the tree
 	t.Unlock()
 
-	// Read lock the tree
-	t.RLock()
-	defer t.RUnlock()
+	// Compact the frozen memtable (if it has anything in it)
+	var addErr error
+	if frozen.Len() > 0 {
+		table, err := frozen.compact(t.newBuilder(level), t.merge)
+		if err != nil {
+			return err
+		}
 
-	// Compact the frozen memtable
-	levelNum := 1
-	levelPath := t.levelDir()
-	table, err := t.frozenMemtable.Compact(levelPath, levelNum)
-	if err != nil {
-		return nil, err
+		// Add the new table to the first level, and drop the frozen
+		// memtable at the same time, so readers never see both (and
+		// apply its merge records twice)
+		edit := versionEdit{
+			Added:      refs(level.Number(), []*SSTable{table}),
+			LastSeq:    t.seq.Load(),
+			FlushedSeq: table.meta.MaxSeq,
+		}
+		if err := t.manifest.Log(edit); err != nil {
+			table.remove()
+			return err
+		}
+
+		// The table is always added (see ReplaceTables), so an error
+		// here is only from cleaning up, and the WAL is still deleted
+		t.Lock()
+		addErr = level.AddTable(table)
+		t.frozenMemtable = nil
+		t.flushedSeq = max(t.flushedSeq, edit.FlushedSeq)
+		t.Unlock()
+		if addErr != nil {
+			addErr = fmt.Errorf("failed to update level 1 after flushing memtable: %w", addErr)
+		}
+	} else {
+		// Now that the data is durable, drop the frozen memtable
+		t.Lock()
+		t.frozenMemtable = nil
+		t.Unlock()
 	}
 
-	// Delete the frozen memtable
-	if err := t.frozenMemtable.Close(); err != nil {
-		return nil, err
+	// Delete its WAL
+	if err := frozen.Close(); err != nil {
+		return errors.Join(addErr, err)
 	}
-	t.frozenMemtable = nil
 
 	// Done
-	return table, nil
+	return addErr
 }
 
-func (t *LSMTree) lastLevelIsFull() bool {
-	// Ensure that there is at least one level
-	if len(t.levels) == 0 {
-		return false
+func (t *LSMTree) walDir() string {
+	return path.Join(t.path, WALDirName)
+}
+
+// nextWAL creates a new WAL file, with an id one greater
+// than the active memtable's WAL.
+func (t *LSMTree) nextWAL() (*WAL, error) {
+	var id uint64
+	if t.memtable != nil && t.memtable.wal != nil {
+		id = t.memtable.wal.ID() + 1
+	}
+	return CreateWAL(t.walDir(), id)
+}
+
+// newTreeBlockCache creates a tree's block cache with the
+// configured size: 0 uses DefaultBlockCacheSize, and a negative
+// size disables the cache.
+func newTreeBlockCache(size int64) *BlockCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultBlockCacheSize
+	}
+	return NewBlockCache(uint64(size))
+}
+
+// BlockCacheStats returns the tree's block cache counters, or
+// zeros if the cache is disabled.
+func (t *LSMTree) BlockCacheStats() BlockCacheStats {
+	if t.cache == nil {
+		return BlockCacheStats{}
+	}
+	return t.cache.Stats()
+}
+
+// newBuilder returns a builder for a new table in the level,
+// configured with the tree's table options.
+func (t *LSMTree) newBuilder(l *Level) *SSTBuilder {
+	return &SSTBuilder{
+		Path:            l.path,
+		Level:           l.meta.Level,
+		Compression:     t.compression,
+		BloomBitsPerKey: t.bloomBits,
+		PrefixLength:    t.prefixLength,
 	}
-	return t.levels[len(t.levels)-1].Full()
 }
 
 func (t *LSMTree) levelDir() string {
-	return path.Join(t.path, "levels")
+	return path.Join(t.path, LevelsDirName)
 }
 
+// addLevel adds a new, empty level to the bottom of the tree.
+// The caller must hold the tree's write lock.
 func (t *LSMTree) addLevel() error {
 	// Get the next level's number
 	ln := uint16(len(t.levels) + 1)
@@ -227,15 +827,81 @@ func (t *LSMTree) addLevel() error {
 	if err != nil {
 		return err
 	}
+	level.setPartitioned(t.strategy.Partitioned(ln))
+	level.setCache(t.cache)
+	if err := t.manifest.Log(versionEdit{Levels: ln}); err != nil {
+		// Remove the level's directory, so it can be created
+		// again next time
+		level.Close()
+		os.RemoveAll(level.path)
+		return err
+	}
 
 	// Add the level to the tree
 	t.levels = append(t.levels, level)
 
+	// Update the metadata
+	t.meta.Levels = ln
+	if err := t.writeMeta(); err != nil {
+		return err
+	}
+
 	// Done
 	return nil
 }
 
+// version returns the tables in each of the tree's levels, and
+// its last sequence number.
+func (t *LSMTree) version() *version {
+	v := &version{
+		levels:     make([][]string, len(t.levels)),
+		lastSeq:    t.seq.Load(),
+		flushedSeq: t.flushedSeq,
+	}
+	for i, l := range t.levels {
+		v.levels[i] = ids(l.Tables())
+	}
+	return v
+}
+
+// removeExtraLevels deletes level directories past the tree's
+// last level (e.g. from a crash while adding a level).
+func (t *LSMTree) removeExtraLevels() error {
+	ents, err := os.ReadDir(t.levelDir())
+	if err != nil {
+		return fmt.Errorf("failed to read levels directory: %w", err)
+	}
+	for _, e := range ents {
+		var n uint16
+		if _, err := fmt.Sscanf(e.Name(), "level-%04d", &n); err != nil || !e.IsDir() {
+			continue
+		}
+		if n > uint16(len(t.levels)) {
+			if err := os.RemoveAll(path.Join(t.levelDir(), e.Name())); err != nil {
+				return fmt.Errorf("failed to remove extra level %d: %w", n, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *LSMTree) writeMeta() error {
+	b, err := json.Marshal(t.meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tree metadata: %w", err)
+	}
+	p := path.Join(t.path, TreeMetaFileName)
+	if err := writeFileAtomic(p, b); err != nil {
+		return fmt.Errorf("failed to write tree metadata to file: %w", err)
+	}
+	return nil
+}
+
 type LSMTreeMeta struct {
+	CreatedAt     time.Time `json:"createdAt"`               // When the tree was created
+	Levels        uint16    `json:"levels"`                  // Number of levels in the tree
+	Compaction    string    `json:"compaction,omitempty"`    // Name of the tree's compaction strategy
+	MergeOperator string    `json:"mergeOperator,omitempty"` // Name of the tree's merge operator
 }
 
 func fmtLevelPath(levelPath string, level uint16) string {
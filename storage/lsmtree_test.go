@@ -0,0 +1,568 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewLSMTree(t *testing.T) {
+	t.Run("should lay out a new tree directory", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		defer tree.Close()
+
+		for _, p := range []string{TreeMetaFileName, WALDirName, LevelsDirName} {
+			if _, err := os.Stat(path.Join(d, p)); err != nil {
+				t.Fatalf("expected %q to exist: %s", p, err)
+			}
+		}
+
+		// A second tree in the same place should fail
+		if _, err := NewLSMTree(NewLSMTreeConf{Path: d}); err == nil {
+			t.Fatalf("expected an error creating a tree over an existing one")
+		}
+	})
+}
+
+func TestLoadLSMTree(t *testing.T) {
+	t.Run("should see the same data after a restart", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		if err := tree.Put("a", map[string]any{"n": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Put("b", map[string]any{"n": 2.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+
+		v, err := tree.Get("b")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if v["n"] != 2.0 {
+			t.Fatalf("expected n=2, got %v", v["n"])
+		}
+
+		r, err := tree.memtable.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if r == nil || !r.Tomb {
+			t.Fatalf("expected a tombstone for key %q, got %+v", "a", r)
+		}
+
+		// The sequence numbers should carry on from the WAL
+		if err := tree.Put("c", map[string]any{}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		r, err = tree.memtable.Get("c")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if r.Seq != 4 {
+			t.Fatalf("expected seq 4, got %d", r.Seq)
+		}
+	})
+
+	t.Run("should not reuse sequence numbers dropped by compaction", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		for i := range 2 {
+			if err := tree.Put("a", map[string]any{"n": i}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		_, seq, err := tree.GetVersion("a")
+		if err != nil {
+			t.Fatalf("failed to get version: %s", err)
+		}
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+
+		// Drop every record, so the tables don't hold any sequence numbers
+		flushTestTree(t, tree)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		for _, k := range []string{"b", "a"} {
+			if err := tree.Put(k, map[string]any{}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		if err := tree.CompareAndSwap("a", seq, map[string]any{}); !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("expected a stale version to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestLSMTree_Compact(t *testing.T) {
+	t.Run("should flush a full memtable to the first level", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		tree.memtable.maxSize = 4
+		walID := tree.memtable.wal.ID()
+
+		for _, k := range []string{"c", "a", "b"} {
+			if err := tree.Put(k, map[string]any{"k": k}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		if err := tree.Del("b"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if err := tree.Compact(); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+
+		// The data should be in a table in the first level
+		if len(tree.levels) != 1 || len(tree.levels[0].tables) != 1 {
+			t.Fatalf("expected 1 level with 1 table")
+		}
+		table := tree.levels[0].tables[0]
+		if table.meta.RecordCount != 3 || table.meta.MinKey != "a" || table.meta.MaxKey != "c" {
+			t.Fatalf("unexpected table metadata: %+v", table.meta)
+		}
+		if r, err := table.Get("b"); err != nil || r == nil || !r.Tomb {
+			t.Fatalf("expected a tombstone for key %q, got %+v (err=%v)", "b", r, err)
+		}
+
+		// ...and the old WAL should be gone
+		if _, err := os.Stat(fmtWALPath(tree.walDir(), walID)); !os.IsNotExist(err) {
+			t.Fatalf("expected wal id=%d to be deleted", walID)
+		}
+
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		// It should all still be there after a restart
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+
+		// ...and the sequence numbers should carry on from the tables
+		if seq := tree.seq.Load(); seq != 4 {
+			t.Fatalf("expected last seq 4, got %d", seq)
+		}
+		for _, k := range []string{"a", "c"} {
+			v, err := tree.Get(k)
+			if err != nil {
+				t.Fatalf("failed to get: %s", err)
+			}
+			if v["k"] != k {
+				t.Fatalf("expected k=%q, got %v", k, v["k"])
+			}
+		}
+	})
+
+	t.Run("should flush in the background", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		tree.memtable.maxSize = 2
+
+		for _, k := range []string{"a", "b"} {
+			if err := tree.Put(k, map[string]any{"k": k}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+
+		// Wait for the flush
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			tree.RLock()
+			flushed := len(tree.levels) == 1 && tree.levels[0].Len() == 1 && tree.frozenMemtable == nil
+			tree.RUnlock()
+			if flushed {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for background flush")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if err := tree.CompactionErr(); err != nil {
+			t.Fatalf("unexpected compaction error: %s", err)
+		}
+		for _, k := range []string{"a", "b"} {
+			if v, err := tree.Get(k); err != nil || v["k"] != k {
+				t.Fatalf("expected k=%q, got %v (err=%v)", k, v, err)
+			}
+		}
+	})
+
+	t.Run("should keep one error per failing background job", func(t *testing.T) {
+		c := newCompactor(nil, -1)
+		flush, compact := compactionJob{flush: true}, compactionJob{level: 0, output: 1}
+		for i := range 100 {
+			c.report(flush, fmt.Errorf("flush failed %d", i))
+		}
+		c.report(compact, errors.New("compaction failed"))
+		err := c.err()
+		if err == nil || err.Error() != "flush failed 99\ncompaction failed" {
+			t.Fatalf("expected the last error from each job, got %v", err)
+		}
+	})
+
+	t.Run("should drop tombstones in the bottommost level", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+
+		// Delete a key in a newer table than the one it was written to
+		for _, k := range []string{"a", "b"} {
+			if err := tree.Put(k, map[string]any{"k": k}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+		}
+		flushTestTree(t, tree)
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+
+		// ...and another, while a snapshot that can still see it is live
+		if err := tree.Put("c", map[string]any{"k": "c"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		snap := tree.Snapshot()
+		defer snap.Release()
+		if err := tree.Del("c"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		flushTestTree(t, tree)
+
+		// Compact them into the (new, bottommost) second level
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if tree.levels[1].Len() != 1 {
+			t.Fatalf("expected 1 table in the second level, got %d", tree.levels[1].Len())
+		}
+		table := tree.levels[1].tables[0]
+		if r, err := table.Get("a"); err != nil || r != nil {
+			t.Fatalf("expected the tombstone for key %q to be dropped, got %+v (err=%v)", "a", r, err)
+		}
+		if r, err := table.Get("c"); err != nil || r == nil || !r.Tomb {
+			t.Fatalf("expected to keep the tombstone for key %q, got %+v (err=%v)", "c", r, err)
+		}
+		if table.meta.Tombstones != 1 {
+			t.Fatalf("expected 1 tombstone, got %d", table.meta.Tombstones)
+		}
+		if v, err := snap.Get("c"); err != nil || v["k"] != "c" {
+			t.Fatalf("expected the snapshot to see key %q, got %v (err=%v)", "c", v, err)
+		}
+		for _, k := range []string{"a", "c"} {
+			if v, err := tree.Get(k); err != nil || v != nil {
+				t.Fatalf("expected key %q to be deleted, got %v (err=%v)", k, v, err)
+			}
+		}
+	})
+
+	t.Run("should merge whole tiers with the size-tiered strategy", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{
+			Path:               d,
+			CompactionWorkers:  -1,
+			CompactionStrategy: SizeTieredCompaction{MinTables: 2},
+		})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+
+		// Write overlapping tables, overwriting "a" each time
+		for i, k := range []string{"b", "c", "d", "e"} {
+			if err := tree.Put("a", map[string]any{"v": float64(i)}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+			if err := tree.Put(k, map[string]any{"v": float64(i)}); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+			flushTestTree(t, tree)
+			if err := tree.Compact(); err != nil {
+				t.Fatalf("failed to compact: %s", err)
+			}
+		}
+
+		// Two merges of two tables into the second tier, then
+		// one merge of those into the third
+		if len(tree.levels) != 3 {
+			t.Fatalf("expected 3 levels, got %d", len(tree.levels))
+		}
+		for i, n := range []int{0, 0, 1} {
+			if l := tree.levels[i]; l.Len() != n || l.partitioned {
+				t.Fatalf("expected level %d to have %d overlapping tables, got %d", i+1, n, l.Len())
+			}
+		}
+		if v, err := tree.Get("a"); err != nil || v["v"] != 3.0 {
+			t.Fatalf("expected key %q to have v=3, got %v (err=%v)", "a", v, err)
+		}
+
+		// The strategy should be remembered after a restart
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		if name := tree.strategy.Name(); name != "size-tiered" {
+			t.Fatalf("expected size-tiered strategy, got %q", name)
+		}
+		if _, err := LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionStrategy: LeveledCompaction{}}); err == nil {
+			t.Fatalf("expected an error loading with a different strategy")
+		}
+	})
+}
+
+func TestLSMTree_PutWithTTL(t *testing.T) {
+	t.Run("should expire keys after their ttl", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.PutWithTTL("a", map[string]any{"k": "a"}, time.Hour); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Put("b", map[string]any{"k": "b"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if v, err := tree.Get("a"); err != nil || v["k"] != "a" {
+			t.Fatalf("expected key %q before it expires, got %v (err=%v)", "a", v, err)
+		}
+
+		// Write a record that has already expired, rather than
+		// waiting for one to
+		if err := tree.memtable.Put(Record{
+			Key:     "c",
+			Expires: time.Now().Add(-time.Second).UnixNano(),
+			Value:   map[string]any{"k": "c"},
+		}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+
+		// Once it expires, reads should treat it as missing
+		if v, err := tree.Get("c"); err != nil || v != nil {
+			t.Fatalf("expected key %q to have expired, got %v (err=%v)", "c", v, err)
+		}
+		it := tree.Scan("", "")
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Close(); err != nil {
+			t.Fatalf("failed to close iterator: %s", err)
+		}
+		if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+			t.Fatalf("expected keys [a b], got %v", keys)
+		}
+
+		// ...and compaction should remove it
+		flushTestTree(t, tree)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		table := tree.levels[1].tables[0]
+		if table.meta.RecordCount != 2 {
+			t.Fatalf("expected 2 records left, got %d", table.meta.RecordCount)
+		}
+		if r, err := table.Get("c"); err != nil || r != nil {
+			t.Fatalf("expected key %q to be removed, got %+v (err=%v)", "c", r, err)
+		}
+	})
+
+	t.Run("should reject a non-positive ttl", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.PutWithTTL("a", map[string]any{}, 0); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("should reject empty keys", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.PutWithTTL("", map[string]any{}, time.Hour); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey, got %v", err)
+		}
+	})
+}
+
+func TestLSMTree_Put(t *testing.T) {
+	t.Run("should not see changes made to a value after it was put", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		v := map[string]any{"n": 1, "l": []any{"x"}}
+		if err := tree.Put("a", v); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		v["n"] = 99
+		v["l"].([]any)[0] = "y"
+		expected := map[string]any{"n": int64(1), "l": []any{"x"}}
+		if got, err := tree.Get("a"); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %v, got %v (err=%v)", expected, got, err)
+		}
+
+		// ...and the same value should be replayed from the WAL
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		if got, err := tree.Get("a"); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %v after reloading, got %v (err=%v)", expected, got, err)
+		}
+	})
+
+	t.Run("should reject empty keys", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("", map[string]any{"n": 1}); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey from Put, got %v", err)
+		}
+		if err := tree.Del(""); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey from Del, got %v", err)
+		}
+	})
+}
+
+func TestLSMTree_Compression(t *testing.T) {
+	t.Run("should read tables written with different compressors", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		// Write a table without compression...
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		if err := tree.Put("a", map[string]any{"k": "a"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		// ...and one with it
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1, Compression: DeflateCompression})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		if err := tree.Put("b", map[string]any{"k": "b"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+
+		tables := tree.levels[0].tables
+		if len(tables) != 2 || tables[0].meta.Compression != NoCompression || tables[1].meta.Compression != DeflateCompression {
+			t.Fatalf("expected one table with each compressor")
+		}
+		for _, k := range []string{"a", "b"} {
+			if v, err := tree.Get(k); err != nil || v["k"] != k {
+				t.Fatalf("expected k=%q, got %v (err=%v)", k, v, err)
+			}
+		}
+	})
+}
+
+// newTestTree creates a new tree in a temporary directory,
+// which is closed and removed when the test finishes.
+func newTestTree(t *testing.T, conf NewLSMTreeConf) *LSMTree {
+	t.Helper()
+	d, err := os.MkdirTemp("", "lsmtree")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	conf.Path = d
+	tree, err := NewLSMTree(conf)
+	if err != nil {
+		os.RemoveAll(d)
+		t.Fatalf("failed to create tree: %s", err)
+	}
+	t.Cleanup(func() {
+		tree.Close()
+		os.RemoveAll(d)
+	})
+	return tree
+}
+
+// flushTestTree flushes the tree's memtable to the first level.
+func flushTestTree(t *testing.T, tree *LSMTree) {
+	t.Helper()
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush memtable: %s", err)
+	}
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync"
+)
+
+const (
+	ManifestFileName    = "MANIFEST"
+	manifestTmpFileName = "MANIFEST.tmp"
+)
+
+// manifestEntryEdit is the type of a manifest frame holding
+// a JSON-encoded versionEdit.
+const manifestEntryEdit walEntryType = 1
+
+// versionEdit is a change to the set of tables in a tree's
+// levels, logged to the manifest as a single frame so that
+// it's applied all at once (or not at all).
+//
+// Edits also record the tree's last sequence number, since the
+// tables don't always hold it (e.g. once compaction has dropped
+// the newest records), and it must never go backwards. For the
+// same reason, flushes record the last sequence number in the
+// flushed memtable, so its records aren't replayed from a WAL
+// that outlived it.
+type versionEdit struct {
+	Levels     uint16     `json:"levels,omitempty"`     // The new number of levels (0 if unchanged)
+	Added      []tableRef `json:"added,omitempty"`      // Tables added to levels
+	Removed    []tableRef `json:"removed,omitempty"`    // Tables removed from levels
+	LastSeq    uint64     `json:"lastSeq,omitempty"`    // The last sequence number assigned when the edit was made
+	FlushedSeq uint64     `json:"flushedSeq,omitempty"` // The last sequence number in the flushed memtable (flushes only)
+}
+
+// tableRef identifies a table in a level.
+type tableRef struct {
+	Level uint16 `json:"level"`
+	ID    string `json:"id"`
+}
+
+// refs returns references to the tables, in the level n.
+func refs(n uint16, tables []*SSTable) []tableRef {
+	rs := make([]tableRef, len(tables))
+	for i, t := range tables {
+		rs[i] = tableRef{Level: n, ID: t.id}
+	}
+	return rs
+}
+
+// version is the set of tables in each of a tree's levels, as
+// rebuilt by replaying the manifest's edits.
+type version struct {
+	levels     [][]string // The ids of the tables in each level, in the order they were added
+	lastSeq    uint64     // The highest last sequence number recorded by the edits
+	flushedSeq uint64     // The highest sequence number flushed from a memtable
+}
+
+// apply applies the edit to the version.
+func (v *version) apply(e versionEdit) error {
+	v.lastSeq = max(v.lastSeq, e.LastSeq)
+	v.flushedSeq = max(v.flushedSeq, e.FlushedSeq)
+	for len(v.levels) < int(e.Levels) {
+		v.levels = append(v.levels, nil)
+	}
+	for _, r := range e.Removed {
+		if r.Level < 1 || int(r.Level) > len(v.levels) {
+			return fmt.Errorf("edit removes table id=%q from missing level %d", r.ID, r.Level)
+		}
+		v.levels[r.Level-1] = slices.DeleteFunc(v.levels[r.Level-1], func(id string) bool {
+			return id == r.ID
+		})
+	}
+	for _, r := range e.Added {
+		if r.Level < 1 || int(r.Level) > len(v.levels) {
+			return fmt.Errorf("edit adds table id=%q to missing level %d", r.ID, r.Level)
+		}
+		v.levels[r.Level-1] = append(v.levels[r.Level-1], r.ID)
+	}
+	return nil
+}
+
+// edit returns a single edit that rebuilds the version from scratch.
+func (v *version) edit() versionEdit {
+	e := versionEdit{Levels: uint16(len(v.levels)), LastSeq: v.lastSeq, FlushedSeq: v.flushedSeq}
+	for i, ids := range v.levels {
+		for _, id := range ids {
+			e.Added = append(e.Added, tableRef{Level: uint16(i + 1), ID: id})
+		}
+	}
+	return e
+}
+
+// manifest is an append-only log of the edits made to the
+// tables in a tree's levels.
+//
+// Every change to a tree's tables (a flush, a compaction, or a
+// new level) is logged as one edit before it's applied, so
+// changes that touch several levels are atomic. When a tree is
+// loaded, the edits are replayed to find its live tables, and
+// any other table directories are removed.
+type manifest struct {
+	sync.Mutex
+	path string   // The path to the manifest file
+	file *os.File // The open manifest file handle
+	torn bool     // Whether a torn edit was dropped from the end when it was opened
+	err  error    // Set when a failed edit couldn't be undone
+}
+
+// createManifest writes a new manifest in the tree directory d,
+// holding the version v, replacing any existing manifest.
+//
+// The new manifest is written to a temporary file and renamed
+// into place, so a crash leaves either the old or the new one.
+func createManifest(d string, v *version) (*manifest, error) {
+	// Write the new manifest
+	tp := path.Join(d, manifestTmpFileName)
+	f, err := os.OpenFile(tp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %w", err)
+	}
+	b, err := json.Marshal(v.edit())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to marshal manifest edit: %w", err)
+	}
+	if err := writeFrame(f, manifestEntryEdit, b); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	// Move it into place
+	p := path.Join(d, ManifestFileName)
+	if err := os.Rename(tp, p); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to rename manifest: %w", err)
+	}
+	if err := syncDir(d); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &manifest{
+		path: p,
+		file: f,
+	}, nil
+}
+
+// openManifest opens the manifest in the tree directory d and
+// replays its edits, returning the current version.
+//
+// It returns an error wrapping os.ErrNotExist if the tree
+// doesn't have a manifest. Since the manifest is always written
+// with its base version (see createManifest), a manifest whose
+// first frame is missing or corrupt returns a *CorruptionError,
+// rather than an empty version. A torn edit at the end is dropped,
+// and the manifest's torn field is set.
+func openManifest(d string) (*manifest, *version, error) {
+	p := path.Join(d, ManifestFileName)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+
+	// Replay the edits
+	v := &version{}
+	end, torn, err := readFrames(f, func(typ walEntryType, payload []byte, off int64) error {
+		if typ != manifestEntryEdit {
+			return fmt.Errorf("unknown manifest entry type %d at offset %d", typ, off)
+		}
+		var e versionEdit
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return fmt.Errorf("failed to unmarshal manifest edit at offset %d: %w", off, err)
+		}
+		if err := v.apply(e); err != nil {
+			return fmt.Errorf("failed to apply manifest edit at offset %d: %w", off, err)
+		}
+		return nil
+	})
+	if err == nil && end == 0 {
+		err = &CorruptionError{
+			File:   ManifestFileName,
+			Reason: "missing or corrupt base version",
+		}
+	}
+	if err == nil && torn {
+		err = truncateFrames(f, end)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to replay manifest: %w", err)
+	}
+	return &manifest{
+		path: p,
+		file: f,
+		torn: torn,
+	}, v, nil
+}
+
+// Log appends the edit to the manifest and syncs it to disk.
+//
+// If the edit can't be written, it's cut off again, so it can't
+// break the edits logged after it. If that fails too, the manifest
+// refuses any further edits.
+func (m *manifest) Log(e versionEdit) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest edit: %w", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.file == nil {
+		return errors.New("manifest is closed")
+	}
+	if m.err != nil {
+		return fmt.Errorf("manifest failed: %w", m.err)
+	}
+	if err := appendFrame(m.file, manifestEntryEdit, b, &m.err); err != nil {
+		return fmt.Errorf("failed to write manifest edit: %w", err)
+	}
+	return nil
+}
+
+// Close closes the manifest's file handle.
+func (m *manifest) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	t.Run("should replay edits in order", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "manifest")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		m, err := createManifest(d, &version{})
+		if err != nil {
+			t.Fatalf("failed to create manifest: %s", err)
+		}
+		edits := []versionEdit{
+			{Levels: 1},
+			{Added: []tableRef{{Level: 1, ID: "a"}}},
+			{Added: []tableRef{{Level: 1, ID: "b"}}},
+			{Levels: 2},
+			{Added: []tableRef{{Level: 2, ID: "c"}}, Removed: []tableRef{{Level: 1, ID: "a"}, {Level: 1, ID: "b"}}},
+			{Added: []tableRef{{Level: 1, ID: "d"}}},
+		}
+		for _, e := range edits {
+			if err := m.Log(e); err != nil {
+				t.Fatalf("failed to log edit: %s", err)
+			}
+		}
+		if err := m.Close(); err != nil {
+			t.Fatalf("failed to close manifest: %s", err)
+		}
+
+		m, v, err := openManifest(d)
+		if err != nil {
+			t.Fatalf("failed to open manifest: %s", err)
+		}
+		defer m.Close()
+		if len(v.levels) != 2 || !slices.Equal(v.levels[0], []string{"d"}) || !slices.Equal(v.levels[1], []string{"c"}) {
+			t.Fatalf("unexpected version: %+v", v.levels)
+		}
+	})
+
+	t.Run("should recover the levels from the manifest", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		if err := tree.Put("a", map[string]any{"k": "a"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		l2 := tree.levels[1]
+		id := l2.tables[0].id
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		// Lose the second level's metadata update, as if the tree
+		// crashed right after logging the compaction...
+		var meta LevelMeta
+		mp := path.Join(l2.path, LevelMetaFileName)
+		b, err := os.ReadFile(mp)
+		if err != nil {
+			t.Fatalf("failed to read level meta: %s", err)
+		}
+		if err := json.Unmarshal(b, &meta); err != nil {
+			t.Fatalf("failed to unmarshal level meta: %s", err)
+		}
+		meta.Tables = []string{}
+		if b, err = json.Marshal(meta); err != nil {
+			t.Fatalf("failed to marshal level meta: %s", err)
+		}
+		if err := os.WriteFile(mp, b, 0644); err != nil {
+			t.Fatalf("failed to write level meta: %s", err)
+		}
+
+		// ...and leave behind a half-written table
+		orphan := path.Join(l2.path, "orphan")
+		if err := os.Mkdir(orphan, 0755); err != nil {
+			t.Fatalf("failed to create orphan: %s", err)
+		}
+
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+
+		if l := tree.levels[1]; l.Len() != 1 || l.tables[0].id != id || !slices.Equal(l.meta.Tables, []string{id}) {
+			t.Fatalf("expected the table from the manifest in level 2")
+		}
+		if v, err := tree.Get("a"); err != nil || v["k"] != "a" {
+			t.Fatalf("expected k=%q, got %v (err=%v)", "a", v, err)
+		}
+		if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+			t.Fatalf("expected the orphaned table to be removed")
+		}
+	})
+
+	t.Run("should refuse to load a tree with a corrupt base version", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		if err := tree.Put("a", map[string]any{"k": "a"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		// Reload it, so the manifest is rewritten as a single frame
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		// Corrupt it, and make sure the tree isn't loaded as empty
+		flipTestByte(t, path.Join(d, ManifestFileName), walHeaderSize+2)
+		if _, err := LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1}); !errors.Is(err, ErrCorruption) {
+			t.Fatalf("expected a corruption error, got %v", err)
+		}
+		if _, err := os.Stat(fmtLevelPath(path.Join(d, LevelsDirName), 1)); err != nil {
+			t.Fatalf("expected the first level to be left alone: %s", err)
+		}
+	})
+
+	t.Run("should not clean up after a torn edit", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		if err := tree.Put("a", map[string]any{"k": "a"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		id := tree.levels[0].tables[0].id
+		lp := tree.levels[0].path
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		// Tear the last edit (the one adding the flushed table)
+		mp := path.Join(d, ManifestFileName)
+		fi, err := os.Stat(mp)
+		if err != nil {
+			t.Fatalf("failed to stat manifest: %s", err)
+		}
+		if err := os.Truncate(mp, fi.Size()-3); err != nil {
+			t.Fatalf("failed to truncate manifest: %s", err)
+		}
+
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		if _, err := os.Stat(path.Join(lp, id)); err != nil {
+			t.Fatalf("expected the table from the torn edit to be left alone: %s", err)
+		}
+	})
+	t.Run("should refuse edits after a failed write can't be undone", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "manifest")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		m, err := createManifest(d, &version{})
+		if err != nil {
+			t.Fatalf("failed to create manifest: %s", err)
+		}
+		defer m.Close()
+		if err := m.Log(versionEdit{Levels: 1}); err != nil {
+			t.Fatalf("failed to log edit: %s", err)
+		}
+
+		// Swap in a read-only handle, so both the write and the
+		// truncate that would undo it fail
+		f := m.file
+		ro, err := os.Open(path.Join(d, ManifestFileName))
+		if err != nil {
+			t.Fatalf("failed to open manifest: %s", err)
+		}
+		m.file = ro
+		if err := m.Log(versionEdit{Added: []tableRef{{Level: 1, ID: "a"}}}); err == nil {
+			t.Fatalf("expected the edit to fail")
+		}
+		m.file = f
+		ro.Close()
+
+		// The manifest should stay failed, even though it's writable again
+		if err := m.Log(versionEdit{Added: []tableRef{{Level: 1, ID: "b"}}}); err == nil {
+			t.Fatalf("expected edits to a failed manifest to fail")
+		}
+
+		// ...and still open, with only the edits that were logged
+		m2, v, err := openManifest(d)
+		if err != nil {
+			t.Fatalf("failed to open manifest: %s", err)
+		}
+		defer m2.Close()
+		if len(v.levels) != 1 || len(v.levels[0]) != 0 {
+			t.Fatalf("unexpected version: %+v", v.levels)
+		}
+	})
+	t.Run("should finish swapping in compacted tables when cleaning up fails", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1, MergeOperator: AddMergeOperator})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		for range 2 {
+			if err := tree.Merge("a", map[string]any{"n": 1}); err != nil {
+				t.Fatalf("failed to merge: %s", err)
+			}
+			flushTestTree(t, tree)
+		}
+
+		// Block the output level's metadata from being written
+		if err := tree.addLevel(); err != nil {
+			t.Fatalf("failed to add level: %s", err)
+		}
+		tmp := path.Join(tree.levels[1].path, LevelMetaFileName+".tmp")
+		if err := os.Mkdir(tmp, 0755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := tree.compactLevel(0, 1); err == nil {
+			t.Fatalf("expected an error writing the level's metadata")
+		}
+
+		// The compaction should still have been applied in full
+		if n := tree.levels[0].Len(); n != 0 {
+			t.Fatalf("expected the inputs to be removed, got %d tables", n)
+		}
+		expectMergedN(t, tree, "a", 2)
+
+		// ...and the tree should load with the compacted tables
+		if err := os.Remove(tmp); err != nil {
+			t.Fatalf("failed to remove dir: %s", err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		if n := tree.levels[0].Len(); n != 0 {
+			t.Fatalf("expected no tables in the first level after loading, got %d", n)
+		}
+		expectMergedN(t, tree, "a", 2)
+	})
+	t.Run("should remove a new level if its edit can't be logged", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{CompactionWorkers: -1})
+		n := len(tree.levels)
+
+		// Fail the manifest, so the edit adding the level is refused
+		tree.manifest.err = errors.New("injected failure")
+		if err := tree.addLevel(); err == nil {
+			t.Fatalf("expected an error adding a level")
+		}
+		p := fmtLevelPath(tree.levelDir(), uint16(n+1))
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected the new level's directory to be removed, got %v", err)
+		}
+
+		// ...so adding it can be retried
+		tree.manifest.err = nil
+		if err := tree.addLevel(); err != nil {
+			t.Fatalf("failed to add level: %s", err)
+		}
+		if len(tree.levels) != n+1 {
+			t.Fatalf("expected %d levels, got %d", n+1, len(tree.levels))
+		}
+	})
+}
@@ -2,7 +2,10 @@ package storage
 
 import (
 	"fmt"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/btree"
 )
@@ -12,40 +15,150 @@ const (
 	DefaultMaxTableSize = 1 << 10
 )
 
+// Memtable is an in-memory table of recent writes.
+//
+// It keeps every version of each key written to it, ordered
+// by key and then newest first, so that snapshots can read
+// the version that was current when they were taken.
 type Memtable struct {
 	sync.RWMutex
-	tree    *btree.BTreeG[string]
-	hmap    map[string]Record
+	tree    *btree.BTreeG[Record]
 	wal     *WAL
+	seq     *atomic.Uint64 // The last sequence number assigned (shared by a tree's memtables)
 	maxSize uint64
 	frozen  bool
 }
 
-func NewMemtable() *Memtable {
-	tree := btree.NewOrderedG[string](DefaultTreeOrder)
-	hmap := make(map[string]Record)
+// NewMemtable creates a new, empty memtable that logs its
+// writes to the given WAL.
+//
+// If wal is nil, writes aren't logged (and won't survive
+// a crash). Writes are assigned sequence numbers from seq,
+// which should be shared by all of a tree's memtables; if
+// it's nil, the memtable gets its own counter.
+func NewMemtable(wal *WAL, seq *atomic.Uint64) *Memtable {
+	tree := btree.NewG(DefaultTreeOrder, recordLess)
+	if seq == nil {
+		seq = new(atomic.Uint64)
+	}
 	return &Memtable{
 		tree:    tree,
-		hmap:    hmap,
-		wal:     nil,
+		wal:     wal,
+		seq:     seq,
 		maxSize: DefaultMaxTableSize,
 		frozen:  false,
 	}
 }
 
+// LoadMemtable creates a new memtable from the records in
+// an existing WAL, replaying them in the order they were
+// written. New writes to the memtable are appended to
+// the same WAL.
+//
+// The sequence counter seq is advanced past the highest
+// sequence number found in the log.
+func LoadMemtable(wal *WAL, seq *atomic.Uint64) (*Memtable, error) {
+	return replayMemtable(wal, seq, 0)
+}
+
+// replayMemtable is like LoadMemtable, but if flushed isn't 0,
+// it skips the records with a sequence number <= flushed (which
+// are already in a table).
+func replayMemtable(wal *WAL, seq *atomic.Uint64, flushed uint64) (*Memtable, error) {
+	m := NewMemtable(wal, seq)
+	if err := wal.Replay(func(r Record) error {
+		if flushed == 0 || r.Seq > flushed {
+			m.apply(r)
+		}
+		if r.Seq > m.seq.Load() {
+			m.seq.Store(r.Seq)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to replay wal id=%d: %w", wal.ID(), err)
+	}
+	return m, nil
+}
+
+// recordLess orders records by key and then by sequence
+// number, newest first.
+func recordLess(a, b Record) bool {
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.newer(b)
+}
+
+// Get returns the newest version of the key's record, or
+// nil if it isn't in the memtable.
 func (m *Memtable) Get(k string) (*Record, error) {
+	return m.GetAt(k, math.MaxUint64)
+}
+
+// GetAt returns the newest version of the key's record with a
+// sequence number <= seq, or nil if there isn't one.
+func (m *Memtable) GetAt(k string, seq uint64) (*Record, error) {
 	m.RLock()
 	defer m.RUnlock()
+	return m.getAt(k, seq), nil
+}
 
-	// Get the record
-	r, ok := m.hmap[k]
-	if !ok {
-		return nil, nil
-	}
-	return &r, nil
+// getAt is like GetAt, but the caller must hold the lock.
+func (m *Memtable) getAt(k string, seq uint64) *Record {
+	var found *Record
+	m.tree.AscendGreaterOrEqual(Record{Key: k, Seq: seq}, func(r Record) bool {
+		if r.Key == k {
+			found = &r
+		}
+		return false
+	})
+	return found
+}
+
+// versions returns the key's versions with a sequence number
+// <= seq, newest first, up to and including the newest one that
+// isn't a merge record.
+func (m *Memtable) versions(k string, seq uint64) versionChain {
+	m.RLock()
+	defer m.RUnlock()
+	return m.versionsLocked(k, seq)
+}
+
+// versionsLocked is like versions, but the caller must hold
+// the lock.
+func (m *Memtable) versionsLocked(k string, seq uint64) versionChain {
+	var c versionChain
+	m.tree.AscendGreaterOrEqual(Record{Key: k, Seq: seq}, func(r Record) bool {
+		return r.Key == k && !c.add(r)
+	})
+	return c
 }
 
 func (m *Memtable) Put(r Record) error {
+	return m.write([]Record{r})
+}
+
+// Write applies the batch's records atomically -- they're logged
+// as a single WAL entry and applied under one write lock, so
+// readers see either all of them or none of them.
+func (m *Memtable) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return m.write(slices.Clone(b.records))
+}
+
+// write assigns the records sequence numbers, logs them and
+// applies them to the memtable, under the write lock.
+func (m *Memtable) write(rs []Record) error {
+	return m.writeIf(rs, nil)
+}
+
+// writeIf is like write, but first calls check (if it isn't
+// nil) while holding the write lock, and only writes the
+// records if it returns nil. No other writes to the memtable
+// can happen between the check and the write.
+func (m *Memtable) writeIf(rs []Record, check func() error) error {
 	m.Lock()
 	defer m.Unlock()
 
@@ -53,16 +166,77 @@ func (m *Memtable) Put(r Record) error {
 		return fmt.Errorf("memtable is frozen")
 	}
 
-	// Set the record in the hash-map
-	m.hmap[r.Key] = r
+	// Check the precondition
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	// Assign the records the next sequence numbers
+	//
+	// Note that this happens under the write lock, so
+	// sequence numbers are logged and applied in order
+	for i := range rs {
+		rs[i].Seq = m.seq.Add(1)
+	}
+
+	// Encode the records once, the way the WAL logs them, and
+	// apply what they decode to. That way values read back with
+	// the same types before and after they're flushed or replayed
+	// (see codec.go), and the memtable doesn't share any maps or
+	// slices with the caller, who could change them afterwards
+	var typ walEntryType
+	var b []byte
+	var err error
+	if len(rs) == 1 {
+		typ = walEntryBinaryRecord
+		if b, err = encodeRecord(rs[0]); err == nil {
+			rs[0], err = unmarshalRecord(b)
+		}
+	} else {
+		typ = walEntryBinaryBatch
+		if b, err = encodeRecords(rs); err == nil {
+			rs, err = unmarshalRecords(b)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode records: %w", err)
+	}
 
-	// Add the record to the tree
-	m.tree.ReplaceOrInsert(r.Key)
+	// Log the records before acknowledging the write
+	if m.wal != nil {
+		if err := m.wal.append(typ, b); err != nil {
+			return err
+		}
+	}
+
+	// Apply the records
+	for _, r := range rs {
+		m.apply(r)
+	}
 
 	// Done
 	return nil
 }
 
+// apply stores the record in the memtable's tree, alongside
+// any older versions of its key. The caller must hold the
+// write lock.
+func (m *Memtable) apply(r Record) {
+	m.tree.ReplaceOrInsert(r)
+}
+
+// LastSeq returns the last sequence number assigned to a write.
+//
+// Since sequence numbers are assigned and applied under the
+// write lock, every write up to and including it is visible.
+func (m *Memtable) LastSeq() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.seq.Load()
+}
+
 func (m *Memtable) Del(k string) error {
 	return m.Put(Record{
 		Key:  k,
@@ -71,7 +245,17 @@ func (m *Memtable) Del(k string) error {
 }
 
 func (m *Memtable) Full() bool {
-	return len(m.hmap) >= int(m.maxSize)
+	m.RLock()
+	defer m.RUnlock()
+	return m.tree.Len() >= int(m.maxSize)
+}
+
+// Len returns the number of records (including older
+// versions of keys) in the memtable.
+func (m *Memtable) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.tree.Len()
 }
 
 func (m *Memtable) Freeze() {
@@ -80,12 +264,91 @@ func (m *Memtable) Freeze() {
 	m.frozen = true
 }
 
-func (m *Memtable) Compact(p string, n int) (*SSTable, error) {
-	return nil, fmt.Errorf("not implemented")
+// Compact writes the memtable's records, in key order, to a
+// new SSTable built by b. The builder should be configured
+// (with its level directory, level number, etc.) but not set up.
+//
+// Only the newest version of each key is written. Tombstones
+// are written too, so that they keep shadowing older versions
+// of their keys in lower levels. The memtable must be frozen
+// first.
+func (m *Memtable) Compact(builder *SSTBuilder) (*SSTable, error) {
+	return m.compact(builder, nil)
+}
+
+// compact is like Compact, but merge records are folded with
+// the merge operator op -- into the value they apply to, if it's
+// in the memtable, or otherwise into a single merge record.
+func (m *Memtable) compact(builder *SSTBuilder, op MergeOperator) (*SSTable, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if !m.frozen {
+		return nil, fmt.Errorf("memtable must be frozen before compacting")
+	}
+	if m.tree.Len() == 0 {
+		return nil, fmt.Errorf("memtable is empty")
+	}
+
+	// Set up the table builder
+	if err := builder.SetUp(); err != nil {
+		return nil, err
+	}
+
+	// Walk the tree in key order, adding the newest
+	// version of each key (folding in any older ones
+	// that it merges with)
+	var err error
+	var chain versionChain
+	add := func() error {
+		r, err := chain.fold(op, false)
+		if err != nil {
+			return err
+		}
+		chain = chain[:0]
+		return builder.Add(r)
+	}
+	m.tree.Ascend(func(r Record) bool {
+		if len(chain) > 0 && chain[0].Key != r.Key {
+			if err = add(); err != nil {
+				return false
+			}
+		}
+		chain.add(r)
+		return true
+	})
+	if err == nil {
+		err = add()
+	}
+	if err != nil {
+		builder.abort()
+		return nil, err
+	}
+
+	// Build the table
+	table, err := builder.Finish()
+	if err != nil {
+		builder.abort()
+		return nil, err
+	}
+	return table, nil
 }
 
+// Close retires the memtable, deleting its WAL.
+//
+// It should only be called once the memtable's records are
+// durable somewhere else (i.e. after it has been compacted
+// and the new table has been added to its level).
 func (m *Memtable) Close() error {
 	m.Lock()
 	defer m.Unlock()
-	return fmt.Errorf("not implemented")
+
+	if m.wal == nil {
+		return nil
+	}
+	if err := m.wal.Delete(); err != nil {
+		return fmt.Errorf("failed to delete wal id=%d: %w", m.wal.ID(), err)
+	}
+	m.wal = nil
+	return nil
 }
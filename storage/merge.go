@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"sync"
+)
+
+const (
+	// AddMergeOperator is the name of the merge operator that
+	// adds each of an operand's (numeric) fields to the value's.
+	AddMergeOperator = "add"
+
+	// AppendMergeOperator is the name of the merge operator that
+	// appends each of an operand's fields to the value's lists.
+	AppendMergeOperator = "append"
+
+	// SetFieldMergeOperator is the name of the merge operator
+	// that sets each of an operand's fields in the value.
+	SetFieldMergeOperator = "set-field"
+)
+
+// MergeOperator folds merge operands (written with LSMTree.Merge)
+// into the values of their keys.
+//
+// Operands are stored as merge records, and only folded into the
+// value when the key is read, or when compaction merges them with
+// the value they apply to. Until then, compaction may also fold
+// operands into each other -- so Merge must be associative, i.e.
+// Merge(Merge(v, a), b) must give the same result as
+// Merge(v, Merge(a, b)).
+//
+// A tree's merge operator is recorded (by name) in its metadata,
+// so it must be registered (with RegisterMergeOperator) before the
+// tree is loaded. The built-in operators are AddMergeOperator,
+// AppendMergeOperator and SetFieldMergeOperator.
+type MergeOperator interface {
+	// Name identifies the operator in tree metadata.
+	Name() string
+
+	// Merge applies the operand to the value (which is nil if the
+	// key doesn't exist, or is another operand) and returns the
+	// result. It must not modify either of its arguments.
+	Merge(value, operand map[string]any) (map[string]any, error)
+}
+
+var mergeOperators = struct {
+	sync.RWMutex
+	byName map[string]MergeOperator
+}{
+	byName: map[string]MergeOperator{
+		AddMergeOperator:      addOperator{},
+		AppendMergeOperator:   appendOperator{},
+		SetFieldMergeOperator: setFieldOperator{},
+	},
+}
+
+// RegisterMergeOperator makes the merge operator available to
+// trees, by its name. It returns an error if an operator with the
+// same name is already registered.
+func RegisterMergeOperator(op MergeOperator) error {
+	mergeOperators.Lock()
+	defer mergeOperators.Unlock()
+	if _, ok := mergeOperators.byName[op.Name()]; ok {
+		return fmt.Errorf("merge operator %q is already registered", op.Name())
+	}
+	mergeOperators.byName[op.Name()] = op
+	return nil
+}
+
+// getMergeOperator returns the registered merge operator with the
+// given name. An empty name means no operator, and returns nil.
+func getMergeOperator(name string) (MergeOperator, error) {
+	if name == "" {
+		return nil, nil
+	}
+	mergeOperators.RLock()
+	defer mergeOperators.RUnlock()
+	op, ok := mergeOperators.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown merge operator %q", name)
+	}
+	return op, nil
+}
+
+// versionChain is a key's versions, newest first, up to and
+// including the newest one that isn't a merge record -- i.e.
+// every version needed to work out the key's value.
+type versionChain []Record
+
+// add appends the versions (which must be newest first) until
+// the chain is complete, and returns true if it is. Versions that
+// aren't older than the last one in the chain are copies of one
+// already in it (e.g. a record that's in both a WAL and a table),
+// so they're skipped, like in mergingIterator.
+func (c *versionChain) add(rs ...Record) bool {
+	for _, r := range rs {
+		if c.complete() {
+			break
+		}
+		if n := len(*c); n > 0 && r.Seq >= (*c)[n-1].Seq {
+			continue
+		}
+		*c = append(*c, r)
+	}
+	return c.complete()
+}
+
+// complete returns true if the chain ends with a version that
+// isn't a merge record.
+func (c versionChain) complete() bool {
+	return len(c) > 0 && !c[len(c)-1].Merge
+}
+
+// fold folds the chain's merge records into a single record, with
+// the newest version's sequence number, using the operator op.
+//
+// If the chain is complete, or all is true (meaning there are no
+// older versions of the key anywhere), the operands are applied to
+// the value they're based on, giving a regular record. Otherwise,
+// they're folded into each other, giving a single merge record.
+func (c versionChain) fold(op MergeOperator, all bool) (Record, error) {
+	newest := c[0]
+	if !newest.Merge {
+		return newest, nil
+	}
+	if op == nil {
+		return Record{}, fmt.Errorf("no merge operator for merge record of key %q", newest.Key)
+	}
+
+	// Find the value the operands apply to, if there is one
+	ops := c
+	var base *Record
+	if c.complete() {
+		ops, base = c[:len(c)-1], &c[len(c)-1]
+	}
+	r := Record{Key: newest.Key, Seq: newest.Seq}
+	var v map[string]any
+	switch {
+	case base != nil:
+		// Tombstones and expired values don't count
+		if base.live() {
+			v, r.Expires = base.Value, base.Expires
+		}
+	case all:
+		// There's no value, so they apply to nil
+	default:
+		// Fold the operands into the oldest one
+		r.Merge = true
+		v, ops = ops[len(ops)-1].Value, ops[:len(ops)-1]
+	}
+
+	// Apply the operands, oldest first
+	for i := len(ops) - 1; i >= 0; i-- {
+		var err error
+		if v, err = op.Merge(v, ops[i].Value); err != nil {
+			return Record{}, fmt.Errorf("failed to merge key %q: %w", newest.Key, err)
+		}
+	}
+	r.Value = v
+	return r, nil
+}
+
+// addOperator adds each of the operand's fields to the value's.
+// Fields that are missing from the value, or aren't numbers, are
+// treated as zero.
+//
+// Integers stay integers (int64, or uint64 if both are unsigned),
+// unless either number is a float.
+type addOperator struct{}
+
+func (addOperator) Name() string {
+	return AddMergeOperator
+}
+
+func (addOperator) Merge(value, operand map[string]any) (map[string]any, error) {
+	out := maps.Clone(value)
+	if out == nil {
+		out = make(map[string]any, len(operand))
+	}
+	for f, d := range operand {
+		n, err := addNumbers(out[f], d)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", f, err)
+		}
+		out[f] = n
+	}
+	return out, nil
+}
+
+// addNumbers returns a + d. If a isn't a number, it returns d.
+func addNumbers(a, d any) (any, error) {
+	y, ok := number(d)
+	if !ok {
+		return nil, fmt.Errorf("can't add a %T", d)
+	}
+	x, ok := number(a)
+	if !ok {
+		return y, nil
+	}
+	switch x := x.(type) {
+	case int64:
+		switch y := y.(type) {
+		case int64:
+			return x + y, nil
+		case uint64:
+			return x + int64(y), nil
+		case float64:
+			return float64(x) + y, nil
+		}
+	case uint64:
+		switch y := y.(type) {
+		case int64:
+			return int64(x) + y, nil
+		case uint64:
+			return x + y, nil
+		case float64:
+			return float64(x) + y, nil
+		}
+	case float64:
+		switch y := y.(type) {
+		case int64:
+			return x + float64(y), nil
+		case uint64:
+			return x + float64(y), nil
+		case float64:
+			return x + y, nil
+		}
+	}
+	panic("unreachable")
+}
+
+// number converts v to an int64, uint64 or float64, returning
+// false if it isn't a number.
+func number(v any) (any, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return nil, false
+}
+
+// appendOperator appends each of the operand's fields to the
+// value's list for that field. If an operand field is a list
+// ([]any), its elements are appended; otherwise the field itself
+// is. A value field that's missing starts out as an empty list,
+// and one that isn't a list is treated as a list of itself.
+type appendOperator struct{}
+
+func (appendOperator) Name() string {
+	return AppendMergeOperator
+}
+
+func (appendOperator) Merge(value, operand map[string]any) (map[string]any, error) {
+	out := maps.Clone(value)
+	if out == nil {
+		out = make(map[string]any, len(operand))
+	}
+	for f, v := range operand {
+		var l []any
+		if old, ok := out[f]; ok {
+			l = append(l, listOf(old)...)
+		}
+		out[f] = append(l, listOf(v)...)
+	}
+	return out, nil
+}
+
+// listOf returns v if it's a list, or a list holding v.
+func listOf(v any) []any {
+	if l, ok := v.([]any); ok {
+		return l
+	}
+	return []any{v}
+}
+
+// setFieldOperator sets each of the operand's fields in the
+// value, leaving its other fields as they are.
+type setFieldOperator struct{}
+
+func (setFieldOperator) Name() string {
+	return SetFieldMergeOperator
+}
+
+func (setFieldOperator) Merge(value, operand map[string]any) (map[string]any, error) {
+	out := maps.Clone(value)
+	if out == nil {
+		out = make(map[string]any, len(operand))
+	}
+	maps.Copy(out, operand)
+	return out, nil
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMergeOperators(t *testing.T) {
+	t.Run("should add numbers", func(t *testing.T) {
+		v, err := addOperator{}.Merge(
+			map[string]any{"n": int64(1), "f": 1.5, "u": uint64(2), "s": "x"},
+			map[string]any{"n": 2, "f": 1, "u": uint8(3), "s": 4, "new": int32(5)},
+		)
+		if err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		expected := map[string]any{"n": int64(3), "f": 2.5, "u": uint64(5), "s": int64(4), "new": int64(5)}
+		if !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v, got %v", expected, v)
+		}
+		if _, err := (addOperator{}).Merge(nil, map[string]any{"n": "x"}); err == nil {
+			t.Fatalf("expected an error adding a string")
+		}
+	})
+
+	t.Run("should append to lists", func(t *testing.T) {
+		v, err := appendOperator{}.Merge(
+			map[string]any{"l": []any{"a"}, "s": "b"},
+			map[string]any{"l": []any{"c", "d"}, "s": "e", "new": "f"},
+		)
+		if err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		expected := map[string]any{"l": []any{"a", "c", "d"}, "s": []any{"b", "e"}, "new": []any{"f"}}
+		if !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v, got %v", expected, v)
+		}
+	})
+
+	t.Run("should set fields", func(t *testing.T) {
+		value := map[string]any{"a": 1, "b": 2}
+		v, err := setFieldOperator{}.Merge(value, map[string]any{"b": 3, "c": 4})
+		if err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		expected := map[string]any{"a": 1, "b": 3, "c": 4}
+		if !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v, got %v", expected, v)
+		}
+		if value["b"] != 2 {
+			t.Fatalf("expected the value not to be modified, got %v", value)
+		}
+	})
+
+	t.Run("should refuse to register a name twice", func(t *testing.T) {
+		if err := RegisterMergeOperator(addOperator{}); err == nil {
+			t.Fatalf("expected an error registering %q again", AddMergeOperator)
+		}
+	})
+}
+
+func TestLSMTree_Merge(t *testing.T) {
+	t.Run("should fold operands into the value on read", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{CompactionWorkers: -1, MergeOperator: AddMergeOperator})
+		if err := tree.Put("a", map[string]any{"n": 1, "k": "a"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Merge("a", map[string]any{"n": 2}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		expectMergedN(t, tree, "a", 3)
+
+		// Flushing folds the operand into the value it applies to
+		flushTestTree(t, tree)
+		expectMergedN(t, tree, "a", 3)
+		if err := tree.Merge("a", map[string]any{"n": 4}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		flushTestTree(t, tree)
+		expectMergedN(t, tree, "a", 7)
+
+		// Compacting into the bottom level folds the rest
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		expectMergedN(t, tree, "a", 7)
+		rs, err := tree.levels[1].versions("a")
+		if err != nil {
+			t.Fatalf("failed to get versions: %s", err)
+		}
+		if len(rs) != 1 || rs[0].Merge || rs[0].Value["k"] != "a" {
+			t.Fatalf("expected a single folded record, got %+v", rs)
+		}
+
+		// Deleting the key starts it over
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if err := tree.Merge("a", map[string]any{"n": 5}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		expectMergedN(t, tree, "a", 5)
+	})
+
+	t.Run("should combine operands without a base until they reach it", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{CompactionWorkers: -1, MergeOperator: AddMergeOperator})
+
+		// Push the base down to the third level
+		if err := tree.Put("a", map[string]any{"n": 10}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if err := tree.compactLevel(1, 2); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+
+		// Flush some operands, and compact them into the second level
+		for _, n := range []int{1, 2} {
+			if err := tree.Merge("a", map[string]any{"n": n}); err != nil {
+				t.Fatalf("failed to merge: %s", err)
+			}
+		}
+		flushTestTree(t, tree)
+		if err := tree.Merge("a", map[string]any{"n": 3}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		flushTestTree(t, tree)
+		expectMergedN(t, tree, "a", 16)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		expectMergedN(t, tree, "a", 16)
+
+		// They should be combined into one operand, since the base
+		// is below them
+		rs, err := tree.levels[1].versions("a")
+		if err != nil {
+			t.Fatalf("failed to get versions: %s", err)
+		}
+		if len(rs) != 1 || !rs[0].Merge || rs[0].Value["n"] != int64(6) {
+			t.Fatalf("expected a single combined operand, got %+v", rs)
+		}
+
+		// Once they reach it, they're folded into it
+		if err := tree.compactLevel(1, 2); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		expectMergedN(t, tree, "a", 16)
+		rs, err = tree.levels[2].versions("a")
+		if err != nil {
+			t.Fatalf("failed to get versions: %s", err)
+		}
+		if len(rs) != 1 || rs[0].Merge {
+			t.Fatalf("expected a single folded record, got %+v", rs)
+		}
+	})
+
+	t.Run("should fold operands in scans and snapshots", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{CompactionWorkers: -1, MergeOperator: AppendMergeOperator})
+		if err := tree.Put("a", map[string]any{"tags": []any{"x"}}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Merge("b", map[string]any{"tags": "x"}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		flushTestTree(t, tree)
+		snap := tree.Snapshot()
+		defer snap.Release()
+		for _, k := range []string{"a", "b"} {
+			if err := tree.Merge(k, map[string]any{"tags": []any{"y", "z"}}); err != nil {
+				t.Fatalf("failed to merge: %s", err)
+			}
+		}
+
+		expected := map[string]any{"tags": []any{"x", "y", "z"}}
+		it := tree.Scan("", "")
+		defer it.Close()
+		var n int
+		for it.Next() {
+			if !reflect.DeepEqual(it.Value(), expected) {
+				t.Fatalf("expected key %q to be %v, got %v", it.Key(), expected, it.Value())
+			}
+			n++
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("failed to scan: %s", err)
+		}
+		if n != 2 {
+			t.Fatalf("expected 2 keys, got %d", n)
+		}
+
+		// The snapshot shouldn't see the later operands
+		v, err := snap.Get("b")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if expected := (map[string]any{"tags": []any{"x"}}); !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v in the snapshot, got %v", expected, v)
+		}
+	})
+
+	t.Run("should keep the merge operator across restarts", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, MergeOperator: SetFieldMergeOperator})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		if err := tree.Put("a", map[string]any{"x": "1", "y": "1"}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.Merge("a", map[string]any{"y": "2"}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+
+		if _, err := LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1, MergeOperator: AddMergeOperator}); err == nil {
+			t.Fatalf("expected an error loading the tree with a different merge operator")
+		}
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		v, err := tree.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if expected := (map[string]any{"x": "1", "y": "2"}); !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v, got %v", expected, v)
+		}
+	})
+
+	t.Run("should not apply operands twice after a crash during a flush", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1, MergeOperator: AddMergeOperator})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		for range 3 {
+			if err := tree.Merge("a", map[string]any{"n": 1}); err != nil {
+				t.Fatalf("failed to merge: %s", err)
+			}
+		}
+
+		// Flush, then put the flushed memtable's WAL back, as if
+		// the tree crashed before deleting it
+		wp := tree.memtable.wal.path
+		b, err := os.ReadFile(wp)
+		if err != nil {
+			t.Fatalf("failed to read wal: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+		if err := os.WriteFile(wp, b, 0644); err != nil {
+			t.Fatalf("failed to restore wal: %s", err)
+		}
+
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		if tree.frozenMemtable == nil {
+			t.Fatalf("expected the restored wal to be loaded as the frozen memtable")
+		}
+		expectMergedN(t, tree, "a", 3)
+		it := tree.Scan("", "")
+		defer it.Close()
+		if !it.Next() || it.Value()["n"] != int64(3) {
+			t.Fatalf("expected a scan to find n=3, got %v (err=%v)", it.Value(), it.Err())
+		}
+	})
+
+	t.Run("should not replay flushed records after compaction drops the newest ones", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "lsmtree")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+		tree, err := NewLSMTree(NewLSMTreeConf{Path: d, CompactionWorkers: -1, MergeOperator: AddMergeOperator})
+		if err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+		if err := tree.Merge("a", map[string]any{"n": 1}); err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		if err := tree.Put("z", map[string]any{}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Del("z"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+
+		// Flush, and compact into the bottommost level, which drops
+		// the newest records (z's) -- then put the flushed memtable's
+		// WAL back, as if the tree crashed before deleting it
+		wp := tree.memtable.wal.path
+		b, err := os.ReadFile(wp)
+		if err != nil {
+			t.Fatalf("failed to read wal: %s", err)
+		}
+		flushTestTree(t, tree)
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if n := tree.levels[1].tables[0].meta.RecordCount; n != 1 {
+			t.Fatalf("expected compaction to leave 1 record, got %d", n)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("failed to close tree: %s", err)
+		}
+		if err := os.WriteFile(wp, b, 0644); err != nil {
+			t.Fatalf("failed to restore wal: %s", err)
+		}
+
+		tree, err = LoadLSMTree(LoadLSMTreeConf{Path: d, CompactionWorkers: -1})
+		if err != nil {
+			t.Fatalf("failed to load tree: %s", err)
+		}
+		defer tree.Close()
+		if tree.frozenMemtable == nil {
+			t.Fatalf("expected the restored wal to be loaded as the frozen memtable")
+		}
+		if n := tree.frozenMemtable.Len(); n != 0 {
+			t.Fatalf("expected none of the flushed records to be replayed, got %d", n)
+		}
+		expectMergedN(t, tree, "a", 1)
+	})
+
+	t.Run("should return an error without a merge operator", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Merge("a", map[string]any{"n": 1}); err == nil {
+			t.Fatalf("expected an error merging without a merge operator")
+		}
+		tree = newTestTree(t, NewLSMTreeConf{CompactionWorkers: -1, MergeOperator: AddMergeOperator})
+		if err := tree.Merge("a", map[string]any{"n": "x"}); err == nil {
+			t.Fatalf("expected an error merging an invalid operand")
+		}
+		if err := tree.Merge("", map[string]any{"n": 1}); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey merging an empty key, got %v", err)
+		}
+	})
+}
+
+// expectMergedN checks that the key's "n" field is n.
+func expectMergedN(t *testing.T, tree *LSMTree, k string, n int64) {
+	t.Helper()
+	v, err := tree.Get(k)
+	if err != nil {
+		t.Fatalf("failed to get: %s", err)
+	}
+	if v["n"] != n {
+		t.Fatalf("expected key %q to have n=%d, got %v", k, n, v)
+	}
+}
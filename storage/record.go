@@ -1,11 +1,72 @@
 package storage
 
+import (
+	"slices"
+	"time"
+)
+
 const RecordIDKey = "_id"
 
 type Record struct {
-	Key   string         `json:"key"`
-	Tomb  bool           `json:"tomb,omitempty"`
-	Value map[string]any `json:"value,omitempty"`
+	Key     string         `json:"key"`
+	Seq     uint64         `json:"seq,omitempty"` // Sequence number of the write, assigned by the memtable
+	Tomb    bool           `json:"tomb,omitempty"`
+	Merge   bool           `json:"merge,omitempty"` // Whether the value is a merge operand (see MergeOperator)
+	Expires int64          `json:"exp,omitempty"`   // When the record expires, in Unix nanoseconds (zero means never)
+	Value   map[string]any `json:"value,omitempty"`
+}
+
+// newer returns true if r is a newer version of its key than o.
+func (r Record) newer(o Record) bool {
+	return r.Seq > o.Seq
+}
+
+// expired returns true if the record has an expiry time
+// that's passed as of now.
+func (r Record) expired(now time.Time) bool {
+	return r.Expires != 0 && r.Expires <= now.UnixNano()
+}
+
+// live returns true if the record holds a value that reads
+// should see -- i.e. it isn't a tombstone, and hasn't expired.
+func (r Record) live() bool {
+	return !r.Tomb && !r.expired(time.Now())
+}
+
+// cloneValue returns a deep copy of a record's value, so callers
+// can modify the values they read without changing what's stored
+// (e.g. in a memtable or the block cache).
+func cloneValue(v map[string]any) map[string]any {
+	if v == nil {
+		return nil
+	}
+	out := make(map[string]any, len(v))
+	for k, e := range v {
+		out[k] = cloneElem(e)
+	}
+	return out
+}
+
+// cloneElem returns a deep copy of one of a value's fields. Only
+// maps, lists and byte slices are mutable -- the other types
+// values are decoded as aren't.
+func cloneElem(e any) any {
+	switch e := e.(type) {
+	case map[string]any:
+		return cloneValue(e)
+	case []any:
+		if e == nil {
+			return e
+		}
+		l := make([]any, len(e))
+		for i, x := range e {
+			l[i] = cloneElem(x)
+		}
+		return l
+	case []byte:
+		return slices.Clone(e)
+	}
+	return e
 }
 
 func NewRecord(did uint, value map[string]any) (Record, error) {
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// errSnapshotReleased is returned by reads through a snapshot
+// after it's been released.
+var errSnapshotReleased = errors.New("snapshot has been released")
+
+// Snapshot is a consistent, read-only view of a tree as of
+// a particular sequence number.
+//
+// Reads through a snapshot ignore any writes made after it
+// was taken. It pins the tables it references, so they aren't
+// deleted by compaction until the snapshot is released.
+type Snapshot struct {
+	sync.Mutex
+	tree           *LSMTree     // The tree the snapshot was taken of
+	seq            uint64       // Writes with a higher sequence number are ignored
+	memtable       *Memtable    // The tree's memtable when the snapshot was taken
+	frozenMemtable *Memtable    // The tree's frozen memtable (if there was one)
+	levels         [][]*SSTable // The pinned tables in each level, oldest first
+	released       bool
+}
+
+// Snapshot takes a snapshot of the tree's current state.
+//
+// The snapshot must be released (with Release) when it's no
+// longer needed, so its tables can be cleaned up.
+func (t *LSMTree) Snapshot() *Snapshot {
+	t.RLock()
+	defer t.RUnlock()
+
+	s := &Snapshot{
+		tree:           t,
+		seq:            t.memtable.LastSeq(),
+		memtable:       t.memtable,
+		frozenMemtable: t.frozenMemtable,
+		levels:         make([][]*SSTable, len(t.levels)),
+	}
+
+	// Pin the tables, in level order (compaction swaps tables
+	// under the tree's write lock, so they're consistent)
+	for i, level := range t.levels {
+		s.levels[i] = level.pin()
+	}
+	t.registerSnapshot(s.seq)
+	return s
+}
+
+// registerSnapshot records that a snapshot at seq is live.
+func (t *LSMTree) registerSnapshot(seq uint64) {
+	t.snapMu.Lock()
+	defer t.snapMu.Unlock()
+	if t.snapshots == nil {
+		t.snapshots = make(map[uint64]int)
+	}
+	t.snapshots[seq]++
+}
+
+// releaseSnapshot records that a snapshot at seq was released.
+func (t *LSMTree) releaseSnapshot(seq uint64) {
+	t.snapMu.Lock()
+	defer t.snapMu.Unlock()
+	if t.snapshots[seq]--; t.snapshots[seq] <= 0 {
+		delete(t.snapshots, seq)
+	}
+}
+
+// oldestSnapshot returns the sequence number of the oldest live
+// snapshot, or math.MaxUint64 if there aren't any.
+func (t *LSMTree) oldestSnapshot() uint64 {
+	t.snapMu.Lock()
+	defer t.snapMu.Unlock()
+	oldest := uint64(math.MaxUint64)
+	for seq := range t.snapshots {
+		oldest = min(oldest, seq)
+	}
+	return oldest
+}
+
+// Seq returns the sequence number the snapshot was taken at.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get returns the value of the key as of the snapshot, or
+// nil if it didn't exist (or was deleted).
+func (s *Snapshot) Get(k string) (map[string]any, error) {
+	r, err := s.get(k)
+	if err != nil || r == nil || !r.live() {
+		return nil, err
+	}
+	return cloneValue(r.Value), nil
+}
+
+// get returns the newest version of the key's record as of
+// the snapshot (with any merge records folded into it),
+// including tombstones.
+func (s *Snapshot) get(k string) (*Record, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.released {
+		return nil, errSnapshotReleased
+	}
+
+	// Check the memtables first, collecting versions until
+	// there's one that isn't a merge record
+	var c versionChain
+	for _, m := range []*Memtable{s.memtable, s.frozenMemtable} {
+		if m != nil && !c.complete() {
+			c.add(m.versions(k, s.seq)...)
+		}
+	}
+
+	// Then check the levels
+	for _, tables := range s.levels {
+		if c.complete() {
+			break
+		}
+		rs, err := tableVersions(tables, k, s.seq)
+		if err != nil {
+			return nil, err
+		}
+		c.add(rs...)
+	}
+
+	// Not found?
+	if len(c) == 0 {
+		return nil, nil
+	}
+
+	// Fold any merge records into the value
+	r, err := c.fold(s.tree.merge, true)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Scan returns an iterator over the live keys in the half-open
+// range [start, end) as of the snapshot. An empty end means the
+// range has no upper bound.
+//
+// The iterator must be closed before the snapshot is released.
+func (s *Snapshot) Scan(start, end string) Iterator {
+	return s.scan(start, end, nil)
+}
+
+// ScanPrefix returns an iterator over the live keys that start
+// with prefix, as of the snapshot.
+//
+// Tables whose prefix bloom filters rule out the prefix are
+// skipped, without reading any of their blocks.
+//
+// The iterator must be closed before the snapshot is released.
+func (s *Snapshot) ScanPrefix(prefix string) Iterator {
+	return s.scan(prefix, prefixEnd(prefix), func(t *SSTable) bool {
+		return t.mightContainPrefix(prefix)
+	})
+}
+
+// scan returns an iterator over the live keys in the range
+// [start, end), skipping the tables that are out of range and,
+// if keep isn't nil, the tables for which it returns false.
+func (s *Snapshot) scan(start, end string, keep func(t *SSTable) bool) Iterator {
+	s.Lock()
+	defer s.Unlock()
+	if s.released {
+		return &treeIterator{
+			merged: newMergingIterator(nil),
+			start:  start,
+			end:    end,
+			e:      errSnapshotReleased,
+		}
+	}
+
+	// Gather the sources, newest first
+	var children []recordIterator
+	children = append(children, newMemtableIterator(s.memtable, s.seq))
+	if s.frozenMemtable != nil {
+		children = append(children, newMemtableIterator(s.frozenMemtable, s.seq))
+	}
+	for _, tables := range s.levels {
+		for i := len(tables) - 1; i >= 0; i-- {
+			t := tables[i]
+			if t.meta.MaxKey < start || (end != "" && t.meta.MinKey >= end) {
+				continue
+			}
+			if keep != nil && !keep(t) {
+				continue
+			}
+			children = append(children, newTableIterator(t))
+		}
+	}
+
+	// Create the iterator
+	merged := newMergingIterator(children)
+	merged.op = s.tree.merge
+	it := &treeIterator{
+		merged: merged,
+		start:  start,
+		end:    end,
+	}
+	it.Seek(start)
+	return it
+}
+
+// prefixEnd returns the smallest key that's greater than every
+// key starting with the prefix p, or "" if there isn't one (i.e.
+// p is empty or all 0xff bytes).
+func prefixEnd(p string) string {
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] < 0xff {
+			return p[:i] + string([]byte{p[i] + 1})
+		}
+	}
+	return ""
+}
+
+// Release releases the snapshot's pinned tables. Tables that
+// were compacted away while the snapshot held them are deleted
+// once no snapshots reference them.
+func (s *Snapshot) Release() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.released {
+		return nil
+	}
+	s.released = true
+	s.tree.releaseSnapshot(s.seq)
+
+	var errs []error
+	for _, tables := range s.levels {
+		for _, t := range tables {
+			if err := t.unref(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	s.levels = nil
+	s.memtable = nil
+	s.frozenMemtable = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+func TestLSMTree_Snapshot(t *testing.T) {
+	t.Run("should ignore writes made after the snapshot", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Put("b", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+
+		snap := tree.Snapshot()
+		defer snap.Release()
+
+		if err := tree.Put("a", map[string]any{"v": 2.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Del("b"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		if err := tree.Put("c", map[string]any{"v": 2.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+
+		// Flushing the memtable shouldn't change what the snapshot sees
+		flushTestTree(t, tree)
+
+		for k, expected := range map[string]any{"a": 1.0, "b": 1.0} {
+			v, err := snap.Get(k)
+			if err != nil {
+				t.Fatalf("failed to get: %s", err)
+			}
+			if v["v"] != expected {
+				t.Fatalf("expected key %q to have v=%v, got %v", k, expected, v)
+			}
+		}
+		if v, err := snap.Get("c"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be missing, got %v (err=%v)", "c", v, err)
+		}
+
+		it := snap.Scan("", "")
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Close(); err != nil {
+			t.Fatalf("failed to close iterator: %s", err)
+		}
+		if !slices.Equal(keys, []string{"a", "b"}) {
+			t.Fatalf("expected keys [a b], got %v", keys)
+		}
+
+		// The tree itself should see the new writes
+		if v, err := tree.Get("a"); err != nil || v["v"] != 2.0 {
+			t.Fatalf("expected key %q to have v=2, got %v (err=%v)", "a", v, err)
+		}
+	})
+
+	t.Run("should keep compacted tables until released", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+		tree.Lock()
+		err := tree.addLevel()
+		tree.Unlock()
+		if err != nil {
+			t.Fatalf("failed to add level: %s", err)
+		}
+
+		snap := tree.Snapshot()
+		old := tree.levels[0].tables[0]
+
+		// Compact the first level into the second
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+
+		// The old table should still be readable by the snapshot
+		oldDir := path.Join(old.path, old.id)
+		if _, err := os.Stat(oldDir); err != nil {
+			t.Fatalf("expected pinned table to still exist: %s", err)
+		}
+		if v, err := snap.Get("a"); err != nil || v["v"] != 1.0 {
+			t.Fatalf("expected key %q to have v=1, got %v (err=%v)", "a", v, err)
+		}
+
+		// ...until the snapshot is released
+		if err := snap.Release(); err != nil {
+			t.Fatalf("failed to release snapshot: %s", err)
+		}
+		if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+			t.Fatalf("expected released table to be deleted")
+		}
+	})
+
+	t.Run("should fail reads after it's released", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		snap := tree.Snapshot()
+		if err := snap.Release(); err != nil {
+			t.Fatalf("failed to release snapshot: %s", err)
+		}
+
+		if _, err := snap.Get("a"); !errors.Is(err, errSnapshotReleased) {
+			t.Fatalf("expected errSnapshotReleased from Get, got %v", err)
+		}
+		for _, it := range []Iterator{snap.Scan("", ""), snap.ScanPrefix("a")} {
+			if it.Next() {
+				t.Fatalf("expected no keys, got %q", it.Key())
+			}
+			if err := it.Err(); !errors.Is(err, errSnapshotReleased) {
+				t.Fatalf("expected errSnapshotReleased from the iterator, got %v", err)
+			}
+			if err := it.Close(); err != nil {
+				t.Fatalf("failed to close iterator: %s", err)
+			}
+		}
+	})
+}
@@ -1,10 +1,12 @@
 package storage
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path"
 	"sync"
@@ -14,36 +16,55 @@ import (
 	"github.com/google/uuid"
 )
 
-const (
-	DefaultBloomFilterSize = 10_000_000
-	DefaultBloomFilterFPR  = 0.01
-)
+// DefaultBloomBitsPerKey is the default number of bloom filter
+// bits per key, which gives a false positive rate of about 1%.
+const DefaultBloomBitsPerKey = 10
 
 const (
-	SSTMetaFileName  = "_meta.json"
-	SSTDataFileName  = "data.dat"
-	SSTBloomFileName = "bloom.dat"
+	SSTMetaFileName        = "_meta.json"
+	SSTDataFileName        = "data.dat"
+	SSTBloomFileName       = "bloom.dat"
+	SSTPrefixBloomFileName = "prefix.dat"
 )
 
 // SSTBuilder is used to build a new SSTable.
 type SSTBuilder struct {
-	Path  string // The path to the level's directory
-	Level uint16 // The table's level
+	Path        string // The path to the level's directory
+	Level       uint16 // The table's level
+	BlockSize   int    // Target data block size (defaults to DefaultBlockSize)
+	Compression string // Name of the compressor for data blocks (defaults to NoCompression)
+
+	BloomBitsPerKey int // Bloom filter bits per key (defaults to DefaultBloomBitsPerKey)
+	PrefixLength    int // Length of the key prefixes in the prefix bloom filter (0 means no prefix filter)
 
 	id     string    // The new table's id
 	minKey string    // The current min key in the table
 	maxKey string    // The current max key in the table
 	count  uint64    // The current record count
+	maxSeq uint64    // The highest sequence number in the table
+	tombs  uint64    // The number of tombstones in the table
 	create time.Time // Create timestamp
 
-	bf   *bloom.BloomFilter // Active bloom filter
-	file *os.File           // Active data file handle
+	comp   Compressor    // Compresses the data blocks
+	block  blockBuilder  // The data block being built
+	blocks []blockHandle // Handles to the blocks written so far
+	offset uint64        // Current offset in the data file
+
+	keys     [][]byte // Keys for the bloom filter
+	prefixes [][]byte // Distinct key prefixes for the prefix bloom filter
+	file     *os.File // Active data file handle
 }
 
 // SetUp sets up the SSTBuilder. It generates a unique id,
-// sets the create timestamp, opens the data file, and
-// initializes the bloom filter.
+// sets the create timestamp, and opens the data file.
 func (b *SSTBuilder) SetUp() error {
+	// Get the compressor
+	comp, err := getCompressor(b.Compression)
+	if err != nil {
+		return err
+	}
+	b.comp = comp
+
 	// Generate an id
 	id, err := uuid.NewRandom()
 	if err != nil {
@@ -68,11 +89,15 @@ func (b *SSTBuilder) SetUp() error {
 	}
 	b.file = f
 
-	// Set up the bloom filter
-	b.bf = bloom.NewWithEstimates(
-		DefaultBloomFilterSize,
-		DefaultBloomFilterFPR,
-	)
+	// Set the block size
+	if b.BlockSize <= 0 {
+		b.BlockSize = DefaultBlockSize
+	}
+
+	// Set the bloom filter size
+	if b.BloomBitsPerKey <= 0 {
+		b.BloomBitsPerKey = DefaultBloomBitsPerKey
+	}
 
 	// Done
 	return nil
@@ -80,56 +105,137 @@ func (b *SSTBuilder) SetUp() error {
 
 // Add adds a record to the SSTable builder.
 //
-// It stores the record in the data file and updates
-// the metadata (min/max keys, record count, bloom filter).
+// Records must be added in ascending key order. It appends the
+// record to the current data block (writing the block out once
+// it's full) and updates the metadata (min/max keys, record count,
+// bloom filter).
 func (tb *SSTBuilder) Add(r Record) error {
-	// Encode the record as json
-	b, err := json.Marshal(r)
-	if err != nil {
-		return err
+	// Make sure the keys are in order
+	if tb.count > 0 && r.Key <= tb.maxKey {
+		return fmt.Errorf("key %q added out of order (after %q)", r.Key, tb.maxKey)
 	}
 
-	// Write the record to the file
-	b = append(b, '\n')
-	if _, err := tb.file.Write(b); err != nil {
+	// Add the record to the block
+	if err := tb.block.add(r); err != nil {
 		return err
 	}
 
-	// Add the key to the bloom filter
-	tb.bf.Add([]byte(r.Key))
+	// Keep the key (and prefix) for the bloom filters
+	tb.keys = append(tb.keys, []byte(r.Key))
+	if n := tb.PrefixLength; n > 0 && len(r.Key) >= n {
+		p := []byte(r.Key[:n])
+		if len(tb.prefixes) == 0 || !bytes.Equal(tb.prefixes[len(tb.prefixes)-1], p) {
+			tb.prefixes = append(tb.prefixes, p)
+		}
+	}
 
 	// Update the min/max keys
-	if tb.count == 0 || r.Key < tb.minKey {
+	if tb.count == 0 {
 		tb.minKey = r.Key
 	}
-	if tb.count == 0 || r.Key > tb.maxKey {
-		tb.maxKey = r.Key
-	}
+	tb.maxKey = r.Key
+	tb.maxSeq = max(tb.maxSeq, r.Seq)
 	tb.count++
+	if r.Tomb {
+		tb.tombs++
+	}
+
+	// Write the block out if it's full
+	if len(tb.block.buf) >= tb.BlockSize {
+		if err := tb.flushBlock(); err != nil {
+			return err
+		}
+	}
 
 	// Done
 	return nil
 }
 
+// Size returns the approximate size, in bytes, of the data
+// written to the table so far.
+func (tb *SSTBuilder) Size() uint64 {
+	return tb.offset + uint64(len(tb.block.buf))
+}
+
+// abort closes the builder's data file and removes the
+// partially written table from disk.
+func (tb *SSTBuilder) abort() error {
+	if tb.file != nil {
+		tb.file.Close()
+		tb.file = nil
+	}
+	return os.RemoveAll(path.Join(tb.Path, tb.id))
+}
+
+// flushBlock writes the current data block (and its checksum)
+// to the data file and records its handle for the index.
+func (tb *SSTBuilder) flushBlock() error {
+	if tb.block.empty() {
+		return nil
+	}
+	b, err := tb.comp.Compress(tb.block.buf)
+	if err != nil {
+		return fmt.Errorf("failed to compress block: %w", err)
+	}
+	n := uint64(len(b))
+	if _, err := tb.file.Write(appendChecksum(b)); err != nil {
+		return err
+	}
+	tb.blocks = append(tb.blocks, blockHandle{
+		firstKey: tb.block.firstKey,
+		offset:   tb.offset,
+		size:     n,
+	})
+	tb.offset += n + checksumSize
+	tb.block.reset()
+	return nil
+}
+
 // Finish finishes building the SSTable.
 //
-// It resets the data file handle, generates the metadata,
-// and generates and stores the metadata and bloom filter
-// to disk, in the given path.
+// It writes out the last data block, the index block and the
+// footer, generates the metadata, and stores the metadata and
+// bloom filter to disk, in the given path. All of the table's
+// files are synced to disk before it returns.
 func (tb *SSTBuilder) Finish() (*SSTable, error) {
-	// Seek back to the beginning of the file
-	if _, err := tb.file.Seek(0, 0); err != nil {
+	// Write the last block
+	if err := tb.flushBlock(); err != nil {
+		return nil, err
+	}
+
+	// Write the index block and footer
+	idx := sstIndex{
+		count:   tb.count,
+		lastKey: tb.maxKey,
+		blocks:  tb.blocks,
+	}
+	ib := appendChecksum(encodeIndex(idx))
+	ft := encodeFooter(sstFooter{
+		indexOffset: tb.offset,
+		indexSize:   uint64(len(ib) - checksumSize),
+		version:     sstFormatVersion,
+	})
+	if _, err := tb.file.Write(append(ib, ft...)); err != nil {
+		return nil, err
+	}
+
+	// Make sure the data is on disk
+	if err := tb.file.Sync(); err != nil {
 		return nil, err
 	}
 
 	// Create the metadata
 	md := SSTMeta{
-		ID:          tb.id,
-		Level:       tb.Level,
-		MinKey:      tb.minKey,
-		MaxKey:      tb.maxKey,
-		RecordCount: tb.count,
-		CreatedAt:   tb.create,
+		ID:           tb.id,
+		Level:        tb.Level,
+		MinKey:       tb.minKey,
+		MaxKey:       tb.maxKey,
+		RecordCount:  tb.count,
+		MaxSeq:       tb.maxSeq,
+		Tombstones:   tb.tombs,
+		Compression:  tb.comp.Name(),
+		PrefixLength: tb.PrefixLength,
+		CreatedAt:    tb.create,
 	}
 
 	// Write the metadata to disk
@@ -138,27 +244,45 @@ func (tb *SSTBuilder) Finish() (*SSTable, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := os.WriteFile(mdp, b, 0644); err != nil {
+	if err := writeFileSync(mdp, b); err != nil {
 		return nil, err
 	}
 
-	// Write the bloom filter to disk
-	bfp := path.Join(tb.Path, tb.id, SSTBloomFileName)
-	b, err = tb.bf.MarshalBinary()
-	if err != nil {
+	// Build the bloom filters, now that we know how many keys
+	// there are, and write them to disk
+	bf := newBloomFilter(tb.keys, tb.BloomBitsPerKey)
+	if err := writeBloomFilter(path.Join(tb.Path, tb.id, SSTBloomFileName), bf); err != nil {
 		return nil, err
 	}
-	if err := os.WriteFile(bfp, b, 0644); err != nil {
+	var pbf *bloom.BloomFilter
+	if tb.PrefixLength > 0 {
+		pbf = newBloomFilter(tb.prefixes, tb.BloomBitsPerKey)
+		if err := writeBloomFilter(path.Join(tb.Path, tb.id, SSTPrefixBloomFileName), pbf); err != nil {
+			return nil, err
+		}
+	}
+	tb.keys, tb.prefixes = nil, nil
+
+	// Sync the new directory entries
+	if err := syncDir(path.Join(tb.Path, tb.id)); err != nil {
+		return nil, err
+	}
+	if err := syncDir(tb.Path); err != nil {
 		return nil, err
 	}
 
 	// Create the sstable
 	t := &SSTable{
-		id:    tb.id,
-		path:  tb.Path,
-		meta:  md,
-		file:  tb.file,
-		bloom: tb.bf,
+		id:          tb.id,
+		path:        tb.Path,
+		meta:        md,
+		file:        tb.file,
+		bloom:       bf,
+		prefixBloom: pbf,
+		index:       idx,
+		size:        tb.offset + uint64(len(ib)+len(ft)),
+		comp:        tb.comp,
+		checksums:   true,
 	}
 
 	// Done
@@ -175,13 +299,26 @@ type SSTable struct {
 	meta  SSTMeta
 	file  *os.File
 	bloom *bloom.BloomFilter
+	// Bloom filter of the keys' first meta.PrefixLength bytes (nil if there isn't one)
+	prefixBloom *bloom.BloomFilter
+	index       sstIndex
+	size        uint64      // Size of the data file, in bytes
+	comp        Compressor  // Decompresses the data blocks
+	cache       *BlockCache // Caches decoded data blocks (may be nil)
+	checksums   bool        // Whether the blocks have checksums (false for version 1 tables)
+	legacy      bool        // Whether the records are JSON-encoded (for version 1 and 2 tables)
+
+	refs     int  // Number of snapshots using the table
+	obsolete bool // Whether the table should be deleted once unused
 }
 
 // ReadSSTable reads in an existing SSTable, with the given id,
 // at the given path, and returns it.
 //
 // It reads in the SSTable's metadata, opens a file handle,
-// and generates the bloom filter.
+// reads the data file's footer and index block, and loads
+// the bloom filter. If the index block or bloom filter fail
+// their checksums, it returns a *CorruptionError.
 func ReadSSTable(p string, id string) (*SSTable, error) {
 	// Format the directory path
 	dirp := path.Join(p, id)
@@ -197,17 +334,10 @@ func ReadSSTable(p string, id string) (*SSTable, error) {
 		return nil, fmt.Errorf("failed to unmarshal sst id=%q meta file as json: %w", id, err)
 	}
 
-	// Read in the bloom filter
-	bfPath := path.Join(dirp, SSTBloomFileName)
-	f, err := os.Open(bfPath)
+	// Get the compressor the table was written with
+	comp, err := getCompressor(meta.Compression)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open sst id=%q bloom filter: %w", id, err)
-	}
-	defer f.Close()
-
-	var bloom bloom.BloomFilter
-	if err := binary.Read(f, binary.LittleEndian, &bloom); err != nil {
-		return nil, fmt.Errorf("failed to read sst id=%q bloom filter: %w", id, err)
+		return nil, fmt.Errorf("failed to read sst id=%q: %w", id, err)
 	}
 
 	// Open the data file
@@ -217,16 +347,130 @@ func ReadSSTable(p string, id string) (*SSTable, error) {
 		return nil, fmt.Errorf("failed to open sst id=%q data file: %w", id, err)
 	}
 
+	// Read the index (and the format version, from the footer)
+	idx, ft, err := readIndex(file, id)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read sst id=%q index: %w", id, err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat sst id=%q data file: %w", id, err)
+	}
+
+	// Read in the bloom filters
+	bf, err := readBloomFilter(path.Join(dirp, SSTBloomFileName), id, ft.checksummed())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read sst id=%q bloom filter: %w", id, err)
+	}
+	var pbf *bloom.BloomFilter
+	if meta.PrefixLength > 0 {
+		pbf, err = readBloomFilter(path.Join(dirp, SSTPrefixBloomFileName), id, ft.checksummed())
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read sst id=%q prefix bloom filter: %w", id, err)
+		}
+	}
+
 	// Create and return the table
 	return &SSTable{
-		id:    id,
-		path:  p,
-		meta:  meta,
-		file:  file,
-		bloom: &bloom,
+		id:          id,
+		path:        p,
+		meta:        meta,
+		file:        file,
+		bloom:       bf,
+		prefixBloom: pbf,
+		index:       idx,
+		size:        uint64(fi.Size()),
+		comp:        comp,
+		checksums:   ft.checksummed(),
+		legacy:      ft.legacyRecords(),
 	}, nil
 }
 
+// readIndex reads the footer from the end of table id's data
+// file, then the index block it points to.
+func readIndex(f *os.File, id string) (sstIndex, sstFooter, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return sstIndex{}, sstFooter{}, err
+	}
+	corrupt := func(off int64, reason string) error {
+		return &CorruptionError{Table: id, File: SSTDataFileName, Offset: off, Reason: reason}
+	}
+	if fi.Size() < sstFooterSize {
+		return sstIndex{}, sstFooter{}, corrupt(0, fmt.Sprintf("data file is too small (%d bytes)", fi.Size()))
+	}
+
+	// Read the footer
+	b := make([]byte, sstFooterSize)
+	if _, err := f.ReadAt(b, fi.Size()-sstFooterSize); err != nil {
+		return sstIndex{}, sstFooter{}, err
+	}
+	ft, err := decodeFooter(b)
+	if err != nil {
+		return sstIndex{}, sstFooter{}, corrupt(fi.Size()-sstFooterSize, err.Error())
+	}
+	var sumSize uint64
+	if ft.checksummed() {
+		sumSize = checksumSize
+	}
+	if ft.indexOffset+ft.indexSize+sumSize+sstFooterSize != uint64(fi.Size()) {
+		return sstIndex{}, sstFooter{}, corrupt(fi.Size()-sstFooterSize, "footer index position doesn't match the file size")
+	}
+
+	// Read the index block, and check its checksum
+	b = make([]byte, ft.indexSize+sumSize)
+	if _, err := f.ReadAt(b, int64(ft.indexOffset)); err != nil {
+		return sstIndex{}, sstFooter{}, err
+	}
+	if ft.checksummed() {
+		if b, err = verifyChecksum(b); err != nil {
+			return sstIndex{}, sstFooter{}, corrupt(int64(ft.indexOffset), "index block "+err.Error())
+		}
+	}
+	idx, err := decodeIndex(b)
+	if err != nil {
+		return sstIndex{}, sstFooter{}, corrupt(int64(ft.indexOffset), err.Error())
+	}
+	return idx, ft, nil
+}
+
+// ID returns the table's id.
+func (t *SSTable) ID() string {
+	return t.id
+}
+
+// Meta returns the table's metadata.
+func (t *SSTable) Meta() SSTMeta {
+	return t.meta
+}
+
+// Size returns the size of the table's data file, in bytes.
+func (t *SSTable) Size() uint64 {
+	return t.size
+}
+
+// overlaps returns true if any of the table's keys could be
+// in the range [minKey, maxKey].
+func (t *SSTable) overlaps(minKey, maxKey string) bool {
+	return t.meta.MinKey <= maxKey && t.meta.MaxKey >= minKey
+}
+
+// mightContainPrefix checks if the SSTable *might* contain keys
+// starting with the prefix p, using the prefix bloom filter. If
+// the table doesn't have one, or p is shorter than its prefixes,
+// it returns true.
+func (t *SSTable) mightContainPrefix(p string) bool {
+	n := t.meta.PrefixLength
+	if t.prefixBloom == nil || len(p) < n {
+		return true
+	}
+	return t.prefixBloom.Test([]byte(p[:n]))
+}
+
 // MightContain checks if the SSTable *might* contain the key.
 //
 // It checks if the key is in the table's range and if the key
@@ -234,7 +478,7 @@ func ReadSSTable(p string, id string) (*SSTable, error) {
 func (t *SSTable) MightContain(key string) (bool, error) {
 	// Validate the key
 	if len(key) == 0 {
-		return false, fmt.Errorf("key is empty")
+		return false, ErrEmptyKey
 	}
 
 	// Is it out of range of the min/max?
@@ -251,6 +495,11 @@ func (t *SSTable) MightContain(key string) (bool, error) {
 	return true, nil
 }
 
+// Get returns the key's record from the table, or nil if it
+// isn't found. The record's value is a copy, which the caller
+// can modify.
+//
+// Note that this includes tombstones.
 func (t *SSTable) Get(key string) (*Record, error) {
 	// First check if it *might* be in the table
 	maybe, err := t.MightContain(key)
@@ -261,28 +510,99 @@ func (t *SSTable) Get(key string) (*Record, error) {
 		return nil, nil
 	}
 
-	// Scan the table
-	var record *Record
-	if err := t.scan(func(r Record) (bool, error) {
-		// Have we passed the key?
-		if r.Key > key {
-			return true, nil
+	// Find the block that would hold the key
+	i := t.index.find(key)
+	if i < 0 {
+		return nil, nil
+	}
+
+	// Read and decode it
+	records, err := t.readBlock(t.index.blocks[i])
+	if err != nil {
+		return nil, err
+	}
+
+	// Search the block
+	j := searchBlock(records, key)
+	if j == len(records) || records[j].Key != key {
+		return nil, nil
+	}
+
+	// Copy the record's value, since the block may be cached
+	r := records[j]
+	r.Value = cloneValue(r.Value)
+	return &r, nil
+}
+
+// readBlock reads and decodes the data block with handle h.
+//
+// If the block fails its checksum, or can't be decoded, it
+// returns a *CorruptionError.
+func (t *SSTable) readBlock(h blockHandle) ([]Record, error) {
+	t.Lock()
+	f, cache := t.file, t.cache
+	t.Unlock()
+	if f == nil {
+		return nil, fmt.Errorf("sst id=%q is closed", t.id)
+	}
+
+	// Check the cache first
+	key := blockKey{table: t.id, offset: h.offset}
+	if cache != nil {
+		if records, ok := cache.get(key); ok {
+			return records, nil
 		}
+	}
 
-		// Is it the key we're looking for?
-		if r.Key == key {
-			record = &r
-			return true, nil
+	// Read the block, and check its checksum
+	size := h.size
+	if t.checksums {
+		size += checksumSize
+	}
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, int64(h.offset)); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read sst id=%q block at offset %d: %w", t.id, h.offset, err)
+	}
+	corrupt := func(reason string) error {
+		return &CorruptionError{Table: t.id, File: SSTDataFileName, Offset: int64(h.offset), Reason: reason}
+	}
+	var err error
+	if t.checksums {
+		if b, err = verifyChecksum(b); err != nil {
+			return nil, corrupt("block " + err.Error())
 		}
+	}
 
-		// Otherwise, keep going
-		return false, nil
-	}); err != nil {
-		return nil, err
+	// Decode it
+	b, err = t.comp.Decompress(b)
+	if err != nil {
+		return nil, corrupt(fmt.Sprintf("failed to decompress block: %s", err))
 	}
+	records, err := decodeBlock(b, t.legacy)
+	if err != nil {
+		return nil, corrupt(fmt.Sprintf("failed to decode block: %s", err))
+	}
+	if cache != nil {
+		cache.put(key, records, uint64(len(b)))
+	}
+	return records, nil
+}
 
-	// Done
-	return record, nil
+// setCache sets the cache the table's blocks are read through.
+func (t *SSTable) setCache(c *BlockCache) {
+	t.Lock()
+	defer t.Unlock()
+	t.cache = c
+}
+
+// evict removes the table's blocks from its cache.
+func (t *SSTable) evict() {
+	t.Lock()
+	cache := t.cache
+	t.Unlock()
+	if cache != nil {
+		cache.evictTable(t.id)
+	}
 }
 
 // Close closes the SSTable's open connections.
@@ -290,6 +610,11 @@ func (t *SSTable) Close() error {
 	t.Lock()
 	defer t.Unlock()
 
+	// Already closed?
+	if t.file == nil {
+		return nil
+	}
+
 	// Close the file
 	err := t.file.Close()
 	if err != nil {
@@ -307,61 +632,85 @@ func (t *SSTable) Close() error {
 // function. The function accepts the next record and returns
 // a boolean to signify that the scanner is done.
 func (t *SSTable) scan(fn func(r Record) (done bool, err error)) error {
-	// Lock the table
-	t.Lock()
-	defer t.Unlock()
-
-	// Seek back to the beginning of the file
-	if _, err := t.file.Seek(0, 0); err != nil {
-		return err
-	}
-
-	// Create a new scanner
-	scan := bufio.NewScanner(t.file)
-
-	// Scan the table
-	for scan.Scan() {
-		// Get the record
-		b := scan.Bytes()
-		if len(b) == 0 {
-			continue
-		}
-
-		// Decode the record
-		var r Record
-		if err := json.Unmarshal(b, &r); err != nil {
-			return err
-		}
-
-		// Run the callback
-		done, err := fn(r)
+	for _, h := range t.index.blocks {
+		// Read the next block
+		records, err := t.readBlock(h)
 		if err != nil {
 			return err
 		}
 
-		// If we're done, stop scanning
-		if done {
-			break
+		// Run the callback over its records
+		for _, r := range records {
+			done, err := fn(r)
+			if err != nil {
+				return err
+			}
+
+			// If we're done, stop scanning
+			if done {
+				return nil
+			}
 		}
 	}
 
-	// Check for errors
-	if err := scan.Err(); err != nil {
-		return err
-	}
-
 	// Success!
 	return nil
 }
 
+// DeleteTable deletes the table's files from disk.
+//
+// If the table is pinned by a snapshot, it's marked as
+// obsolete instead, and is deleted once it's released.
 func (t *SSTable) DeleteTable() error {
+	t.Lock()
+	t.obsolete = true
+	inUse := t.refs > 0
+	t.Unlock()
+	t.evict()
+
+	if inUse {
+		return nil
+	}
+	return t.remove()
+}
+
+// ref pins the table, so it isn't deleted while in use.
+func (t *SSTable) ref() {
+	t.Lock()
+	defer t.Unlock()
+	t.refs++
+}
+
+// unref releases a pin on the table, deleting it if it's
+// obsolete and no longer in use.
+func (t *SSTable) unref() error {
+	t.Lock()
+	t.refs--
+	remove := t.refs == 0 && t.obsolete
+	t.Unlock()
+
+	if !remove {
+		return nil
+	}
+
+	// Snapshots may have read blocks back into the cache
+	// since the table was deleted
+	t.evict()
+	return t.remove()
+}
+
+// remove closes the table and removes its files.
+func (t *SSTable) remove() error {
 	// Lock the table
 	t.Lock()
 	defer t.Unlock()
 
 	// Close the file
-	if err := t.file.Close(); err != nil {
-		return err
+	if t.file != nil {
+		if err := t.file.Close(); err != nil {
+			return err
+		}
+		t.file = nil
 	}
 
 	// Format the directory path
@@ -378,56 +727,156 @@ func (t *SSTable) DeleteTable() error {
 		return err
 	}
 
+	pbfp := path.Join(dirp, SSTPrefixBloomFileName)
+	if err := os.Remove(pbfp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
 	dp := path.Join(dirp, SSTDataFileName)
 	if err := os.Remove(dp); err != nil {
 		return err
 	}
 
+	// Delete the (now empty) directory
+	if err := os.Remove(dirp); err != nil {
+		return err
+	}
+
 	// Done
 	return nil
 }
 
+// validate checks that the table's metadata matches its data
+// file -- that the ids and level agree, and that the record
+// count and key range match the data file's index.
+func (t *SSTable) validate(level uint16) error {
+	if t.meta.ID != t.id {
+		return fmt.Errorf("sst id=%q meta has id %q", t.id, t.meta.ID)
+	}
+	if t.meta.Level != level {
+		return fmt.Errorf("sst id=%q meta has level %d, expected %d", t.id, t.meta.Level, level)
+	}
+	if t.index.count != t.meta.RecordCount {
+		return fmt.Errorf("sst id=%q meta has %d records, data file has %d", t.id, t.meta.RecordCount, t.index.count)
+	}
+	var minKey string
+	if len(t.index.blocks) > 0 {
+		minKey = t.index.blocks[0].firstKey
+	}
+	if minKey != t.meta.MinKey || t.index.lastKey != t.meta.MaxKey {
+		return fmt.Errorf(
+			"sst id=%q meta has key range [%q, %q], data file has [%q, %q]",
+			t.id, t.meta.MinKey, t.meta.MaxKey, minKey, t.index.lastKey,
+		)
+	}
+	return nil
+}
+
 type SSTMeta struct {
-	ID          string
-	Level       uint16
-	MinKey      string
-	MaxKey      string
-	RecordCount uint64
-	CreatedAt   time.Time
+	ID           string
+	Level        uint16
+	MinKey       string
+	MaxKey       string
+	RecordCount  uint64
+	MaxSeq       uint64 // The highest sequence number of any record in the table
+	Tombstones   uint64 // The number of records that are tombstones
+	Compression  string // Name of the compressor used for the data blocks
+	PrefixLength int    // Length of the key prefixes in the prefix bloom filter (0 if there isn't one)
+	CreatedAt    time.Time
 }
 
-type sstIterator struct {
-	sync.Mutex
-	table   *SSTable
-	c       chan Record
-	done    bool
-	current Record
-}
-
-func (itr *sstIterator) start() {
-	itr.Lock()
-	itr.c = make(chan Record)
-	itr.Unlock()
-
-	go func() {
-		defer close(itr.c)
-		itr.table.scan(func(r Record) (bool, error) {
-			itr.c <- r
-			return false, nil
-		})
-
-		itr.Lock()
-		itr.done = true
-		itr.Unlock()
-	}()
-}
-
-func (itr *sstIterator) next() bool {
-	itr.Lock()
-	defer itr.Unlock()
-	if itr.done {
-		return false
-	}
-	itr.current = <-itr.c
-	return true
+// tombstoneRatio returns the fraction of the table's
+// records that are tombstones.
+func (m SSTMeta) tombstoneRatio() float64 {
+	if m.RecordCount == 0 {
+		return 0
+	}
+	return float64(m.Tombstones) / float64(m.RecordCount)
+}
+
+// newBloomFilter creates a bloom filter of the keys, with
+// bitsPerKey bits for each one.
+func newBloomFilter(keys [][]byte, bitsPerKey int) *bloom.BloomFilter {
+	m := max(uint(len(keys)*bitsPerKey), 64)
+	k := max(uint(math.Round(float64(bitsPerKey)*math.Ln2)), 1)
+	bf := bloom.New(m, k)
+	for _, key := range keys {
+		bf.Add(key)
+	}
+	return bf
+}
+
+// writeBloomFilter writes the bloom filter to the named file,
+// followed by a CRC32C checksum of it.
+func writeBloomFilter(p string, bf *bloom.BloomFilter) error {
+	b, err := bf.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeFileSync(p, appendChecksum(b))
+}
+
+// readBloomFilter reads table id's bloom filter from the named
+// file, checking its checksum if checksummed is true.
+func readBloomFilter(p, id string, checksummed bool) (*bloom.BloomFilter, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	corrupt := func(reason string) error {
+		return &CorruptionError{Table: id, File: path.Base(p), Reason: reason}
+	}
+	if checksummed {
+		if b, err = verifyChecksum(b); err != nil {
+			return nil, corrupt("bloom filter " + err.Error())
+		}
+	}
+	var bf bloom.BloomFilter
+	if err := bf.UnmarshalBinary(b); err != nil {
+		return nil, corrupt(fmt.Sprintf("failed to decode bloom filter: %s", err))
+	}
+	return &bf, nil
+}
+
+// writeFileSync writes the data to the named file, like
+// os.WriteFile, and syncs it to disk before returning.
+func writeFileSync(p string, b []byte) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileAtomic replaces the named file with the data, by
+// writing it to a temporary file, syncing it, and renaming it
+// into place -- so a crash leaves either the old or new file.
+func writeFileAtomic(p string, b []byte) error {
+	tp := p + ".tmp"
+	if err := writeFileSync(tp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tp, p); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(p))
+}
+
+// syncDir syncs a directory, so that entries created in
+// it are durable.
+func syncDir(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
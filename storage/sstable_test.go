@@ -1,7 +1,12 @@
 package storage
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path"
 	"testing"
 )
 
@@ -26,15 +31,15 @@ func TestSSTBuilder(t *testing.T) {
 
 		// Define the records to add
 		//
-		// Note that in the map, if any of the values are ints they
-		// will be converted to floats (in JSON marshal/unmarshal)
-		// and the following test will fail.
+		// Note that the values use the types they're decoded as
+		// (e.g. int64 rather than int), so they compare equal.
 		minKey, maxKey := "001", "999"
 		records := []Record{
 			{
 				Key: minKey,
 				Value: map[string]any{
 					"foo": 3.14,
+					"bar": int64(1<<53 + 1),
 				},
 			},
 			{
@@ -69,6 +74,8 @@ func TestSSTBuilder(t *testing.T) {
 			MinKey:      minKey,
 			MaxKey:      maxKey,
 			RecordCount: uint64(len(records)),
+			Tombstones:  1,
+			Compression: NoCompression,
 			CreatedAt:   table.meta.CreatedAt,
 		}
 		if table.meta != expectedMeta {
@@ -139,11 +146,453 @@ func TestSSTBuilder(t *testing.T) {
 func TestSSTable(t *testing.T) {}
 
 func TestReadSSTable(t *testing.T) {
-	t.Run("", func(t *testing.T) {
-		// TODO: implement
+	t.Run("should read back a table written by the builder", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "sstable")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		builder := &SSTBuilder{
+			Path:  d,
+			Level: 1,
+		}
+		if err := builder.SetUp(); err != nil {
+			t.Fatalf("failed to set up the builder: %s", err)
+		}
+		keys := []string{"a", "b", "c"}
+		for _, k := range keys {
+			if err := builder.Add(Record{Key: k, Value: map[string]any{"k": k}}); err != nil {
+				t.Fatalf("failed to add record: %s", err)
+			}
+		}
+		written, err := builder.Finish()
+		if err != nil {
+			t.Fatalf("failed to finish the builder: %s", err)
+		}
+		if err := written.Close(); err != nil {
+			t.Fatalf("failed to close table: %s", err)
+		}
+
+		table, err := ReadSSTable(d, written.id)
+		if err != nil {
+			t.Fatalf("failed to read table: %s", err)
+		}
+		defer table.Close()
+
+		if !table.meta.CreatedAt.Equal(written.meta.CreatedAt) {
+			t.Fatalf("expected created at %s, got %s", written.meta.CreatedAt, table.meta.CreatedAt)
+		}
+		if err := table.validate(1); err != nil {
+			t.Fatalf("expected table to be valid: %s", err)
+		}
+		for _, k := range keys {
+			r, err := table.Get(k)
+			if err != nil {
+				t.Fatalf("failed to get key %q: %s", k, err)
+			}
+			if r == nil || r.Value["k"] != k {
+				t.Fatalf("expected record for key %q, got %+v", k, r)
+			}
+		}
+		if r, err := table.Get("z"); err != nil || r != nil {
+			t.Fatalf("expected no record for key %q, got %+v (err=%v)", "z", r, err)
+		}
 	})
 }
 
-func TestSSTable_Get(t *testing.T) {}
+func TestSSTable_Get(t *testing.T) {
+	t.Run("should find keys across many blocks", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "sstable")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		builder := &SSTBuilder{
+			Path:      d,
+			Level:     1,
+			BlockSize: 64,
+		}
+		if err := builder.SetUp(); err != nil {
+			t.Fatalf("failed to set up the builder: %s", err)
+		}
+
+		// Add every other key, so there are gaps to look up
+		n := 500
+		for i := 0; i < n; i += 2 {
+			k := fmt.Sprintf("key-%05d", i)
+			if err := builder.Add(Record{Key: k, Value: map[string]any{"i": float64(i)}}); err != nil {
+				t.Fatalf("failed to add record: %s", err)
+			}
+		}
+		table, err := builder.Finish()
+		if err != nil {
+			t.Fatalf("failed to finish the builder: %s", err)
+		}
+		defer table.Close()
+
+		if len(table.index.blocks) < 2 {
+			t.Fatalf("expected multiple blocks, got %d", len(table.index.blocks))
+		}
+
+		for i := 0; i < n; i++ {
+			k := fmt.Sprintf("key-%05d", i)
+			r, err := table.Get(k)
+			if err != nil {
+				t.Fatalf("failed to get key %q: %s", k, err)
+			}
+			if i%2 == 1 {
+				if r != nil {
+					t.Fatalf("expected no record for key %q, got %+v", k, r)
+				}
+				continue
+			}
+			if r == nil || r.Value["i"] != float64(i) {
+				t.Fatalf("expected record for key %q, got %+v", k, r)
+			}
+		}
+	})
+
+	t.Run("should read compressed blocks", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "sstable")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		// Build the same table with and without compression
+		var tables []*SSTable
+		for _, c := range []string{NoCompression, DeflateCompression} {
+			builder := &SSTBuilder{
+				Path:        d,
+				Level:       1,
+				BlockSize:   256,
+				Compression: c,
+			}
+			if err := builder.SetUp(); err != nil {
+				t.Fatalf("failed to set up the builder: %s", err)
+			}
+			for i := 0; i < 200; i++ {
+				k := fmt.Sprintf("key-%05d", i)
+				if err := builder.Add(Record{Key: k, Value: map[string]any{"i": float64(i), "s": "some repetitive value"}}); err != nil {
+					t.Fatalf("failed to add record: %s", err)
+				}
+			}
+			table, err := builder.Finish()
+			if err != nil {
+				t.Fatalf("failed to finish the builder: %s", err)
+			}
+			table.Close()
+
+			// Read it back, so the compressor comes from the metadata
+			table, err = ReadSSTable(d, table.id)
+			if err != nil {
+				t.Fatalf("failed to read table: %s", err)
+			}
+			defer table.Close()
+			if table.meta.Compression != c {
+				t.Fatalf("expected compression %q, got %q", c, table.meta.Compression)
+			}
+			tables = append(tables, table)
+		}
+		if tables[1].size >= tables[0].size {
+			t.Fatalf("expected the compressed table to be smaller (%d >= %d bytes)", tables[1].size, tables[0].size)
+		}
+
+		for i := 0; i < 200; i++ {
+			k := fmt.Sprintf("key-%05d", i)
+			r, err := tables[1].Get(k)
+			if err != nil {
+				t.Fatalf("failed to get key %q: %s", k, err)
+			}
+			if r == nil || r.Value["i"] != float64(i) {
+				t.Fatalf("expected record for key %q, got %+v", k, r)
+			}
+		}
+	})
+
+	t.Run("should reject an unknown compressor", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "sstable")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		builder := &SSTBuilder{Path: d, Level: 1, Compression: "nope"}
+		if err := builder.SetUp(); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("should reject keys added out of order", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "sstable")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		builder := &SSTBuilder{
+			Path:  d,
+			Level: 1,
+		}
+		if err := builder.SetUp(); err != nil {
+			t.Fatalf("failed to set up the builder: %s", err)
+		}
+		defer builder.file.Close()
+		if err := builder.Add(Record{Key: "b"}); err != nil {
+			t.Fatalf("failed to add record: %s", err)
+		}
+		if err := builder.Add(Record{Key: "a"}); err == nil {
+			t.Fatalf("expected an error adding a key out of order")
+		}
+	})
+}
 
 func TestSSTable_scan(t *testing.T) {}
+
+func TestSSTBuilder_Bloom(t *testing.T) {
+	t.Run("should size the bloom filter from the record count", func(t *testing.T) {
+		var keys []string
+		for i := 0; i < 1000; i++ {
+			keys = append(keys, fmt.Sprintf("key-%05d", i))
+		}
+		var records []Record
+		for _, k := range keys {
+			records = append(records, Record{Key: k})
+		}
+		table := buildTestTable(t, &SSTBuilder{BloomBitsPerKey: 16}, records)
+		if m := table.bloom.Cap(); m != 16*1000 {
+			t.Fatalf("expected %d bits, got %d", 16*1000, m)
+		}
+		if k := table.bloom.K(); k != 11 {
+			t.Fatalf("expected 11 hash functions, got %d", k)
+		}
+		for _, k := range keys {
+			if !table.bloom.Test([]byte(k)) {
+				t.Fatalf("key %s should be in bloom filter", k)
+			}
+		}
+
+		// ...and read the same filter back from disk
+		table.Close()
+		read, err := ReadSSTable(table.path, table.id)
+		if err != nil {
+			t.Fatalf("failed to read table: %s", err)
+		}
+		defer read.Close()
+		if !read.bloom.Equal(table.bloom) {
+			t.Fatalf("expected the same bloom filter after reading the table")
+		}
+	})
+
+	t.Run("should build a prefix bloom filter", func(t *testing.T) {
+		var records []Record
+		for _, k := range []string{"acct-1", "acct-2", "user-1", "user-2"} {
+			records = append(records, Record{Key: k})
+		}
+		table := buildTestTable(t, &SSTBuilder{PrefixLength: 4}, records)
+		if table.meta.PrefixLength != 4 || table.prefixBloom == nil {
+			t.Fatalf("expected a prefix bloom filter")
+		}
+		for _, p := range []string{"acct", "user", "user-", "use"} {
+			if !table.mightContainPrefix(p) {
+				t.Fatalf("expected prefix %q to be in the table", p)
+			}
+		}
+		if table.mightContainPrefix("item") {
+			t.Fatalf("expected prefix %q to be ruled out", "item")
+		}
+
+		table.Close()
+		read, err := ReadSSTable(table.path, table.id)
+		if err != nil {
+			t.Fatalf("failed to read table: %s", err)
+		}
+		defer read.Close()
+		if read.mightContainPrefix("item") || !read.mightContainPrefix("acct") {
+			t.Fatalf("expected the same prefix bloom filter after reading the table")
+		}
+	})
+}
+
+func TestSSTable_Checksums(t *testing.T) {
+	// buildTable builds a closed table with a few blocks
+	buildTable := func(t *testing.T) *SSTable {
+		t.Helper()
+		var records []Record
+		for i := 0; i < 20; i++ {
+			k := fmt.Sprintf("key-%05d", i)
+			records = append(records, Record{Key: k, Value: map[string]any{"k": k}})
+		}
+		table := buildTestTable(t, &SSTBuilder{BlockSize: 64}, records)
+		if err := table.Close(); err != nil {
+			t.Fatalf("failed to close table: %s", err)
+		}
+		if len(table.index.blocks) < 2 {
+			t.Fatalf("expected multiple blocks, got %d", len(table.index.blocks))
+		}
+		return table
+	}
+
+	// expectCorruption checks that err is a corruption error for
+	// the given table, file and offset
+	expectCorruption := func(t *testing.T, err error, id, file string, off int64) {
+		t.Helper()
+		var ce *CorruptionError
+		if !errors.Is(err, ErrCorruption) || !errors.As(err, &ce) {
+			t.Fatalf("expected a corruption error, got %v", err)
+		}
+		if ce.Table != id || ce.File != file || ce.Offset != off {
+			t.Fatalf("expected corruption in sst id=%q %s at offset %d, got %s", id, file, off, ce)
+		}
+	}
+
+	t.Run("should detect a corrupt data block", func(t *testing.T) {
+		written := buildTable(t)
+		h := written.index.blocks[1]
+		flipTestByte(t, path.Join(written.path, written.id, SSTDataFileName), int64(h.offset)+1)
+
+		table, err := ReadSSTable(written.path, written.id)
+		if err != nil {
+			t.Fatalf("failed to read table: %s", err)
+		}
+		defer table.Close()
+
+		// Keys in the other blocks should still be readable
+		if r, err := table.Get(written.index.blocks[0].firstKey); err != nil || r == nil {
+			t.Fatalf("expected to read the first block, got %+v (err=%v)", r, err)
+		}
+		_, err = table.Get(h.firstKey)
+		expectCorruption(t, err, table.id, SSTDataFileName, int64(h.offset))
+		err = table.scan(func(r Record) (bool, error) { return false, nil })
+		expectCorruption(t, err, table.id, SSTDataFileName, int64(h.offset))
+	})
+
+	t.Run("should detect a corrupt index block", func(t *testing.T) {
+		written := buildTable(t)
+		fp := path.Join(written.path, written.id, SSTDataFileName)
+		fi, err := os.Stat(fp)
+		if err != nil {
+			t.Fatalf("failed to stat data file: %s", err)
+		}
+		off := fi.Size() - sstFooterSize - checksumSize - 1
+		flipTestByte(t, fp, off)
+
+		_, err = ReadSSTable(written.path, written.id)
+		idx := int64(written.size) - sstFooterSize - checksumSize - int64(len(encodeIndex(written.index)))
+		expectCorruption(t, err, written.id, SSTDataFileName, idx)
+	})
+
+	t.Run("should detect a corrupt bloom filter", func(t *testing.T) {
+		written := buildTable(t)
+		flipTestByte(t, path.Join(written.path, written.id, SSTBloomFileName), 10)
+
+		_, err := ReadSSTable(written.path, written.id)
+		expectCorruption(t, err, written.id, SSTBloomFileName, 0)
+	})
+
+	t.Run("should read version 1 tables without checksums", func(t *testing.T) {
+		written := buildTable(t)
+
+		// Rewrite the table with JSON records and without checksums,
+		// as the first version of the format had it
+		dirp := path.Join(written.path, written.id)
+		b, err := os.ReadFile(path.Join(dirp, SSTDataFileName))
+		if err != nil {
+			t.Fatalf("failed to read data file: %s", err)
+		}
+		var data []byte
+		idx := written.index
+		idx.blocks = nil
+		for _, h := range written.index.blocks {
+			records, err := decodeBlock(b[h.offset:h.offset+h.size], false)
+			if err != nil {
+				t.Fatalf("failed to decode block: %s", err)
+			}
+			var block []byte
+			for _, r := range records {
+				rb, err := json.Marshal(r)
+				if err != nil {
+					t.Fatalf("failed to marshal record: %s", err)
+				}
+				block = binary.AppendUvarint(block, uint64(len(rb)))
+				block = append(block, rb...)
+			}
+			idx.blocks = append(idx.blocks, blockHandle{firstKey: h.firstKey, offset: uint64(len(data)), size: uint64(len(block))})
+			data = append(data, block...)
+		}
+		ib := encodeIndex(idx)
+		ft := encodeFooter(sstFooter{indexOffset: uint64(len(data)), indexSize: uint64(len(ib)), version: 1})
+		data = append(append(data, ib...), ft...)
+		if err := os.WriteFile(path.Join(dirp, SSTDataFileName), data, 0644); err != nil {
+			t.Fatalf("failed to write data file: %s", err)
+		}
+		bp := path.Join(dirp, SSTBloomFileName)
+		b, err = os.ReadFile(bp)
+		if err != nil {
+			t.Fatalf("failed to read bloom filter: %s", err)
+		}
+		if err := os.WriteFile(bp, b[:len(b)-checksumSize], 0644); err != nil {
+			t.Fatalf("failed to write bloom filter: %s", err)
+		}
+
+		table, err := ReadSSTable(written.path, written.id)
+		if err != nil {
+			t.Fatalf("failed to read table: %s", err)
+		}
+		defer table.Close()
+		if table.checksums || !table.legacy {
+			t.Fatalf("expected a table without checksums, with JSON records")
+		}
+		for _, h := range written.index.blocks {
+			if r, err := table.Get(h.firstKey); err != nil || r == nil || r.Value["k"] != h.firstKey {
+				t.Fatalf("expected record for key %q, got %+v (err=%v)", h.firstKey, r, err)
+			}
+		}
+	})
+}
+
+// buildTestTable builds a table in the first level from the
+// records (which must be in key order) with the builder, in a new
+// temporary directory. The table is closed and removed when the
+// test finishes.
+func buildTestTable(t *testing.T, builder *SSTBuilder, records []Record) *SSTable {
+	t.Helper()
+	d, err := os.MkdirTemp("", "sstable")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(d) })
+
+	builder.Path = d
+	builder.Level = 1
+	if err := builder.SetUp(); err != nil {
+		t.Fatalf("failed to set up the builder: %s", err)
+	}
+	for _, r := range records {
+		if err := builder.Add(r); err != nil {
+			t.Fatalf("failed to add record: %s", err)
+		}
+	}
+	table, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("failed to finish the builder: %s", err)
+	}
+	t.Cleanup(func() { table.Close() })
+	return table
+}
+
+// flipTestByte flips the bits of the byte at offset off in the
+// named file.
+func flipTestByte(t *testing.T, p string, off int64) {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", p, err)
+	}
+	b[off] ^= 0xff
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		t.Fatalf("failed to write %s: %s", p, err)
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import "fmt"
+
+// DefaultSizeTieredMinTables is the default number of tables a
+// tier needs before SizeTieredCompaction merges it.
+const DefaultSizeTieredMinTables = 4
+
+// CompactionStrategy decides when a tree's levels are compacted,
+// which tables are compacted together, and where the output goes.
+//
+// A tree's strategy is chosen when it's created (see NewLSMTreeConf)
+// and its name is stored in the tree's metadata, since the levels'
+// layout depends on it.
+type CompactionStrategy interface {
+	// Name identifies the strategy in the tree's metadata.
+	Name() string
+
+	// Partitioned reports whether the level numbered n holds
+	// non-overlapping tables, sorted by key. Compactions into a
+	// partitioned level are split into tables of the tree's target
+	// table size, and must replace every table they overlap.
+	Partitioned(n uint16) bool
+
+	// NeedsCompaction reports whether the level should be compacted.
+	NeedsCompaction(l *Level) bool
+
+	// OutputLevel returns the number of the level that compacting
+	// l writes to. It can't be lower than l's own number.
+	OutputLevel(l *Level) uint16
+
+	// PickInputs chooses the tables to compact out of l, along with
+	// the tables in the output level they should be merged with.
+	//
+	// Every table in l that holds an older version of one of the
+	// inputs' keys must be an input too, so that reads don't find
+	// the stale version first.
+	PickInputs(l, out *Level) (inputs, overlap []*SSTable)
+}
+
+// LeveledCompaction is the default CompactionStrategy.
+//
+// The first level holds the (possibly overlapping) tables flushed
+// from memtables and is compacted once it has LevelMeta.MaxSize
+// tables. Every level after that holds non-overlapping tables and
+// is compacted once its tables are bigger than LevelMeta.MaxBytes,
+// one table (plus the tables it overlaps in the next level) at a time.
+type LeveledCompaction struct{}
+
+func (LeveledCompaction) Name() string {
+	return "leveled"
+}
+
+func (LeveledCompaction) Partitioned(n uint16) bool {
+	return n > 1
+}
+
+func (LeveledCompaction) NeedsCompaction(l *Level) bool {
+	return l.Full()
+}
+
+func (LeveledCompaction) OutputLevel(l *Level) uint16 {
+	return l.Number() + 1
+}
+
+func (LeveledCompaction) PickInputs(l, out *Level) ([]*SSTable, []*SSTable) {
+	inputs, minKey, maxKey := l.pickCompaction()
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+	return inputs, out.overlapping(minKey, maxKey)
+}
+
+// SizeTieredCompaction is a CompactionStrategy that treats each
+// level as a tier of similarly sized, overlapping tables.
+//
+// Once a tier has MinTables tables, they're all merged into a
+// single (bigger) table in the next tier. Data is rewritten fewer
+// times than with LeveledCompaction, at the cost of reads having
+// to check more tables.
+type SizeTieredCompaction struct {
+	MinTables int // Number of tables that triggers a merge (0 uses DefaultSizeTieredMinTables)
+}
+
+func (SizeTieredCompaction) Name() string {
+	return "size-tiered"
+}
+
+func (SizeTieredCompaction) Partitioned(n uint16) bool {
+	return false
+}
+
+func (s SizeTieredCompaction) NeedsCompaction(l *Level) bool {
+	n := s.MinTables
+	if n <= 0 {
+		n = DefaultSizeTieredMinTables
+	}
+	return l.Len() >= n
+}
+
+func (SizeTieredCompaction) OutputLevel(l *Level) uint16 {
+	return l.Number() + 1
+}
+
+func (SizeTieredCompaction) PickInputs(l, out *Level) ([]*SSTable, []*SSTable) {
+	// Take the whole tier, so every version of a key moves down
+	// together (and the next tier only ever holds older data)
+	return l.Tables(), nil
+}
+
+// compactionStrategy returns the built-in strategy with the given
+// name. An empty name means LeveledCompaction, for trees created
+// before strategies were stored in the metadata.
+func compactionStrategy(name string) (CompactionStrategy, error) {
+	switch name {
+	case "", LeveledCompaction{}.Name():
+		return LeveledCompaction{}, nil
+	case SizeTieredCompaction{}.Name():
+		return SizeTieredCompaction{}, nil
+	}
+	return nil, fmt.Errorf("unknown compaction strategy %q", name)
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConflict is returned when committing a transaction if a
+// key it read was changed by another write after the
+// transaction began.
+var ErrConflict = errors.New("transaction conflict")
+
+// Txn is an optimistic, multi-key transaction.
+//
+// Reads see a snapshot of the tree from when the transaction
+// began (plus the transaction's own writes), and writes are
+// buffered until Commit. On commit, if any key the transaction
+// read has been written since its snapshot, the commit fails
+// with ErrConflict and none of its writes are applied.
+type Txn struct {
+	tree   *LSMTree
+	snap   *Snapshot
+	reads  map[string]uint64 // Version of each key read (0 if it was missing, deleted or expired)
+	writes map[string]Record // The latest buffered write for each key
+	batch  *WriteBatch
+	done   bool
+}
+
+// Begin starts a new transaction.
+//
+// The transaction must be finished with either Commit or
+// Rollback, to release its snapshot.
+func (t *LSMTree) Begin() *Txn {
+	return &Txn{
+		tree:   t,
+		snap:   t.Snapshot(),
+		reads:  make(map[string]uint64),
+		writes: make(map[string]Record),
+		batch:  NewWriteBatch(),
+	}
+}
+
+// Get returns the value of the key, as of the transaction's
+// snapshot (or the transaction's own write to it, if there
+// is one), or nil if it doesn't exist.
+func (tx *Txn) Get(k string) (map[string]any, error) {
+	if tx.done {
+		return nil, errors.New("transaction is finished")
+	}
+
+	// Read our own writes
+	if r, ok := tx.writes[k]; ok {
+		if !r.live() {
+			return nil, nil
+		}
+		return cloneValue(r.Value), nil
+	}
+
+	// Read from the snapshot, tracking the version we saw
+	r, err := tx.snap.get(k)
+	if err != nil {
+		return nil, err
+	}
+	var seq uint64
+	if r != nil && r.live() {
+		seq = r.Seq
+	}
+	if _, ok := tx.reads[k]; !ok {
+		tx.reads[k] = seq
+	}
+	if r == nil || !r.live() {
+		return nil, nil
+	}
+	return cloneValue(r.Value), nil
+}
+
+// Put buffers a put of the value v for the key k.
+func (tx *Txn) Put(k string, v map[string]any) {
+	// Buffer the value as it reads back once it's written, so reads
+	// of it have the same types before and after Commit, and the
+	// caller can't change it after putting it
+	r := normalizeRecord(Record{Key: k, Value: v})
+	tx.batch.Put(k, r.Value)
+	tx.writes[k] = r
+}
+
+// Del buffers a delete of the key k.
+func (tx *Txn) Del(k string) {
+	tx.batch.Del(k)
+	tx.writes[k] = Record{Key: k, Tomb: true}
+}
+
+// Commit atomically applies the transaction's writes, as long
+// as none of the keys it read have changed since it began. If
+// one has, it returns ErrConflict and nothing is written.
+//
+// The transaction is finished either way.
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return errors.New("transaction is finished")
+	}
+	defer tx.finish()
+
+	// Nothing to write?
+	if tx.batch.Len() == 0 {
+		return nil
+	}
+	for _, r := range tx.batch.records {
+		if err := checkKey(r.Key); err != nil {
+			return err
+		}
+	}
+
+	t := tx.tree
+	t.RLock()
+	defer t.RUnlock()
+	defer t.maybeFlush()
+
+	// Validate the reads and apply the writes, under the
+	// memtable's write lock
+	return t.memtable.writeIf(tx.batch.records, func() error {
+		for k, seq := range tx.reads {
+			latest, err := t.versionLocked(k)
+			if err != nil {
+				return err
+			}
+			if latest != seq {
+				return fmt.Errorf("key %q changed: %w", k, ErrConflict)
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback discards the transaction's writes.
+func (tx *Txn) Rollback() error {
+	if tx.done {
+		return nil
+	}
+	return tx.finish()
+}
+
+func (tx *Txn) finish() error {
+	tx.done = true
+	return tx.snap.Release()
+}
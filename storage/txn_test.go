@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	t.Run("should fail with a conflict on a lost update", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("stock", map[string]any{"n": 10.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+
+		// Two transactions read the same key...
+		tx1 := tree.Begin()
+		tx2 := tree.Begin()
+		for _, tx := range []*Txn{tx1, tx2} {
+			v, err := tx.Get("stock")
+			if err != nil {
+				t.Fatalf("failed to get: %s", err)
+			}
+			tx.Put("stock", map[string]any{"n": v["n"].(float64) - 1})
+		}
+
+		// ...the first one to commit wins
+		if err := tx1.Commit(); err != nil {
+			t.Fatalf("failed to commit: %s", err)
+		}
+		if err := tx2.Commit(); !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected ErrConflict, got %v", err)
+		}
+
+		v, err := tree.Get("stock")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		if v["n"] != 9.0 {
+			t.Fatalf("expected n=9, got %v", v["n"])
+		}
+	})
+
+	t.Run("should detect a conflict on a key that was missing", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+
+		tx := tree.Begin()
+		if v, err := tx.Get("a"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be missing, got %v (err=%v)", "a", v, err)
+		}
+		tx.Put("a", map[string]any{"v": 1.0})
+
+		if err := tree.Put("a", map[string]any{"v": 2.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("should commit when other keys change", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+
+		tx := tree.Begin()
+		if _, err := tx.Get("a"); err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		tx.Put("b", map[string]any{"v": 1.0})
+		tx.Del("a")
+
+		// The transaction reads its own writes
+		if v, err := tx.Get("a"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be deleted, got %v (err=%v)", "a", v, err)
+		}
+
+		// An unrelated write (and a flush) shouldn't conflict
+		if err := tree.Put("c", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		flushTestTree(t, tree)
+
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("failed to commit: %s", err)
+		}
+		if v, err := tree.Get("a"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be deleted, got %v (err=%v)", "a", v, err)
+		}
+		if v, err := tree.Get("b"); err != nil || v["v"] != 1.0 {
+			t.Fatalf("expected key %q to have v=1, got %v (err=%v)", "b", v, err)
+		}
+	})
+
+	t.Run("should not conflict when a deleted key's tombstone is dropped", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		if err := tree.Put("a", map[string]any{"v": 1.0}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		if err := tree.Del("a"); err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		flushTestTree(t, tree)
+
+		tx := tree.Begin()
+		if v, err := tx.Get("a"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be deleted, got %v (err=%v)", "a", v, err)
+		}
+		tx.Put("b", map[string]any{"v": 1.0})
+
+		// Compacting into the bottom level drops the tombstone
+		if err := tree.compactLevel(0, 1); err != nil {
+			t.Fatalf("failed to compact: %s", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("failed to commit: %s", err)
+		}
+	})
+	t.Run("should read its own writes the way they're committed", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		tx := tree.Begin()
+		v := map[string]any{"n": 1, "s": []string{"x"}}
+		tx.Put("a", v)
+		v["n"] = 2
+
+		// Changing the value read back shouldn't change the write
+		before, err := tx.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		got, err := tx.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		got["n"] = 99
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("failed to commit: %s", err)
+		}
+
+		after, err := tree.Get("a")
+		if err != nil {
+			t.Fatalf("failed to get: %s", err)
+		}
+		expected := map[string]any{"n": int64(1), "s": []any{"x"}}
+		if !reflect.DeepEqual(before, expected) || !reflect.DeepEqual(after, expected) {
+			t.Fatalf("expected %#v before and after committing, got %#v and %#v", expected, before, after)
+		}
+	})
+
+	t.Run("should not commit writes to an empty key", func(t *testing.T) {
+		tree := newTestTree(t, NewLSMTreeConf{})
+		tx := tree.Begin()
+		tx.Put("a", map[string]any{"v": 1.0})
+		tx.Put("", map[string]any{"v": 1.0})
+		if err := tx.Commit(); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("expected ErrEmptyKey, got %v", err)
+		}
+		if v, err := tree.Get("a"); err != nil || v != nil {
+			t.Fatalf("expected key %q to be missing, got %v (err=%v)", "a", v, err)
+		}
+	})
+}
@@ -1,4 +1,403 @@
 package storage
 
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	WALDirName  = "wals"
+	WALFileExt  = ".wal"
+	walIDFormat = "%016d"
+)
+
+// walHeaderSize is the size of a WAL frame's header.
+//
+// A frame is laid out as:
+//
+//	+-----------+------------+----------+------------------+----------------+
+//	| crc (u32) | size (u32) | type (u8)| header crc (u32) | payload (size) |
+//	+-----------+------------+----------+------------------+----------------+
+//
+// Where the header crc is a CRC32C (Castagnoli) checksum of the
+// size and type, the crc is a checksum of everything after the
+// size, and all integers are little-endian.
+const walHeaderSize = 4 + 4 + 1 + 4
+
+// walEntryType is the type of payload stored in a WAL frame.
+type walEntryType uint8
+
+const (
+	walEntryRecord       walEntryType = iota + 1 // A single JSON-encoded record (no longer written)
+	walEntryBatch                                // A JSON-encoded array of records (no longer written)
+	walEntryBinaryRecord                         // A single binary-encoded record
+	walEntryBinaryBatch                          // A list of binary-encoded records, written atomically
+)
+
 // WAL is a write-ahead log.
-type WAL struct{}
+//
+// It is an append-only file of framed, checksummed records
+// that backs a memtable, so that writes that haven't been
+// flushed to an SSTable yet can be recovered after a crash.
+type WAL struct {
+	sync.Mutex
+	id   uint64   // The WAL's id
+	path string   // The path to the WAL file
+	file *os.File // The open WAL file handle
+	err  error    // Set when a failed append couldn't be undone
+}
+
+// CreateWAL creates a new, empty WAL file with the given id
+// in the directory d.
+func CreateWAL(d string, id uint64) (*WAL, error) {
+	p := fmtWALPath(d, id)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wal id=%d: %w", id, err)
+	}
+	return &WAL{
+		id:   id,
+		path: p,
+		file: f,
+	}, nil
+}
+
+// OpenWAL opens an existing WAL file with the given id in
+// the directory d.
+//
+// The WAL should be replayed (with Replay) before any new
+// records are appended, so that a torn tail is truncated.
+func OpenWAL(d string, id uint64) (*WAL, error) {
+	p := fmtWALPath(d, id)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal id=%d: %w", id, err)
+	}
+	return &WAL{
+		id:   id,
+		path: p,
+		file: f,
+	}, nil
+}
+
+// ListWALs returns the ids of the WAL files in the directory
+// d, in ascending order.
+func ListWALs(d string) ([]uint64, error) {
+	ents, err := os.ReadDir(d)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range ents {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, WALFileExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, WALFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// ID returns the WAL's id.
+func (w *WAL) ID() uint64 {
+	return w.id
+}
+
+// Append writes the record to the end of the log and syncs
+// the file to disk before returning.
+func (w *WAL) Append(r Record) error {
+	b, err := encodeRecord(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode wal record: %w", err)
+	}
+	return w.append(walEntryBinaryRecord, b)
+}
+
+// AppendBatch writes the records to the end of the log as a
+// single frame, so that on replay either all of them or none
+// of them are recovered. It syncs the file to disk before
+// returning.
+func (w *WAL) AppendBatch(rs []Record) error {
+	b, err := encodeRecords(rs)
+	if err != nil {
+		return fmt.Errorf("failed to encode wal batch: %w", err)
+	}
+	return w.append(walEntryBinaryBatch, b)
+}
+
+func (w *WAL) append(t walEntryType, payload []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return fmt.Errorf("wal id=%d is closed", w.id)
+	}
+	if w.err != nil {
+		return fmt.Errorf("wal id=%d failed: %w", w.id, w.err)
+	}
+
+	if err := appendFrame(w.file, t, payload, &w.err); err != nil {
+		return fmt.Errorf("failed to write to wal id=%d: %w", w.id, err)
+	}
+	return nil
+}
+
+// appendFrame writes the payload to the end of the file as a
+// frame (see writeFrame).
+//
+// If the frame can't be written (or synced), the file is cut
+// back to where the frame started. Otherwise the next frame would
+// land after it, and it'd be read back as corrupt (or as if it had
+// been written). If that fails too, the errors are stored in
+// *failed, and the caller should refuse any further appends.
+func appendFrame(f *os.File, t walEntryType, payload []byte, failed *error) error {
+	// Note where the frame starts...
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	off := fi.Size()
+
+	// ...so that it can be cut off again
+	if err := writeFrame(f, t, payload); err != nil {
+		if terr := errors.Join(f.Truncate(off), f.Sync()); terr != nil {
+			*failed = errors.Join(err, terr)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeFrame writes the payload to the file as a single frame
+// of the given type, and syncs the file to disk.
+//
+// Frames are used by both WALs and the manifest.
+func writeFrame(f *os.File, t walEntryType, payload []byte) error {
+	// Build the frame
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	frame[8] = byte(t)
+	binary.LittleEndian.PutUint32(frame[9:13], crc32.Checksum(frame[4:9], crcTable))
+	copy(frame[walHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(frame[0:4], crc32.Checksum(frame[8:], crcTable))
+
+	// Write it and make sure it's on disk
+	if _, err := f.Write(frame); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Replay reads the log from the beginning, calling fn with each
+// record, in the order they were written. Batches are unpacked
+// into their records.
+//
+// If the log ends with a partially written or corrupted frame
+// (for example, from a crash mid-write), the file is truncated
+// to the end of the last good frame and replay stops there. A
+// corrupted frame anywhere else returns a *CorruptionError.
+func (w *WAL) Replay(fn func(r Record) error) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return fmt.Errorf("wal id=%d is closed", w.id)
+	}
+
+	end, torn, err := readFrames(w.file, func(typ walEntryType, payload []byte, off int64) error {
+		var rs []Record
+		var err error
+		switch typ {
+		case walEntryBinaryRecord:
+			var r Record
+			r, err = unmarshalRecord(payload)
+			rs = []Record{r}
+		case walEntryBinaryBatch:
+			rs, err = unmarshalRecords(payload)
+		case walEntryRecord:
+			var r Record
+			err = json.Unmarshal(payload, &r)
+			rs = []Record{r}
+		case walEntryBatch:
+			err = json.Unmarshal(payload, &rs)
+		default:
+			return fmt.Errorf("unknown wal id=%d entry type %d at offset %d", w.id, typ, off)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode wal id=%d entry at offset %d: %w", w.id, off, err)
+		}
+		for _, r := range rs {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if torn {
+		return truncateFrames(w.file, end)
+	}
+	return nil
+}
+
+// readFrames reads the file's frames from the beginning, calling
+// fn with each one's type, payload and offset, in order. It returns
+// the offset of the end of the last frame it read.
+//
+// If the file ends with a partially written frame, reading stops
+// there and torn is true, so the caller can truncate the file to
+// end (with truncateFrames). Since frames are only ever appended, a
+// torn write can only affect the last one -- so a frame that's bad
+// anywhere else is reported as a *CorruptionError. (A crash can
+// also leave the file padded with zeros past the last frame, so a
+// bad frame followed only by zeros is torn too.)
+func readFrames(f *os.File, fn func(typ walEntryType, payload []byte, off int64) error) (end int64, torn bool, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := fi.Size()
+	corrupt := func(off int64, format string, args ...any) error {
+		return &CorruptionError{
+			File:   path.Base(f.Name()),
+			Offset: off,
+			Reason: fmt.Sprintf(format, args...),
+		}
+	}
+
+	// Start at the beginning of the file
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+
+	var off int64
+	header := make([]byte, walHeaderSize)
+	for off < size {
+		// Read the next frame's header (a header cut short by the
+		// end of the file is a torn write)
+		if off+walHeaderSize > size {
+			return off, true, nil
+		}
+		if _, err := io.ReadFull(f, header); err != nil {
+			return off, false, err
+		}
+		hsum := binary.LittleEndian.Uint32(header[9:13])
+		if crc := crc32.Checksum(header[4:9], crcTable); crc != hsum {
+			zeros, err := zeroFrom(f, off, size)
+			if err != nil || zeros {
+				return off, zeros, err
+			}
+			return off, false, corrupt(off, "frame header checksum mismatch (got %#08x, expected %#08x)", crc, hsum)
+		}
+		sum := binary.LittleEndian.Uint32(header[0:4])
+		n := int64(binary.LittleEndian.Uint32(header[4:8]))
+		typ := walEntryType(header[8])
+
+		// A payload that runs past the end of the file is a torn
+		// write (the size is checked against the file before it's
+		// read, so the payload is never bigger than what's on disk)
+		next := off + walHeaderSize + n
+		if next > size {
+			return off, true, nil
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return off, false, err
+		}
+
+		// Verify the checksum (a bad last frame is a torn write)
+		crc := crc32.Update(0, crcTable, header[8:])
+		crc = crc32.Update(crc, crcTable, payload)
+		if crc != sum {
+			zeros, err := zeroFrom(f, next, size)
+			if err != nil || zeros {
+				return off, zeros, err
+			}
+			return off, false, corrupt(off, "frame checksum mismatch (got %#08x, expected %#08x)", crc, sum)
+		}
+
+		// Handle the frame
+		if err := fn(typ, payload, off); err != nil {
+			return off, false, err
+		}
+		off = next
+	}
+	return off, false, nil
+}
+
+// zeroFrom reports whether every byte of the file from off up to
+// size is zero (which is trivially true if off >= size).
+func zeroFrom(f *os.File, off, size int64) (bool, error) {
+	buf := make([]byte, 4096)
+	for off < size {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+		if err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += int64(n)
+	}
+	return true, nil
+}
+
+// truncateFrames cuts the file off at the given offset,
+// dropping a torn tail frame.
+func truncateFrames(f *os.File, off int64) error {
+	if err := f.Truncate(off); err != nil {
+		return fmt.Errorf("failed to truncate torn tail at offset %d: %w", off, err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close closes the WAL's file handle.
+func (w *WAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Delete closes the WAL and removes its file from disk.
+func (w *WAL) Delete() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(w.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func fmtWALPath(d string, id uint64) string {
+	name := fmt.Sprintf(walIDFormat, id) + WALFileExt
+	return path.Join(d, name)
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestWAL(t *testing.T) {
+	t.Run("should replay appended records in order", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "wal")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		w, err := CreateWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to create wal: %s", err)
+		}
+
+		records := []Record{
+			{Key: "b", Value: map[string]any{"n": 1.0}},
+			{Key: "a", Value: map[string]any{"n": 2.0}},
+			{Key: "b", Tomb: true},
+		}
+		for _, r := range records {
+			if err := w.Append(r); err != nil {
+				t.Fatalf("failed to append record: %s", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close wal: %s", err)
+		}
+
+		w, err = OpenWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to open wal: %s", err)
+		}
+		defer w.Close()
+
+		var got []Record
+		if err := w.Replay(func(r Record) error {
+			got = append(got, r)
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to replay wal: %s", err)
+		}
+		if len(got) != len(records) {
+			t.Fatalf("expected %d records, got %d", len(records), len(got))
+		}
+		for i := range records {
+			if got[i].Key != records[i].Key || got[i].Tomb != records[i].Tomb {
+				t.Fatalf("expected record %+v, got %+v", records[i], got[i])
+			}
+		}
+	})
+
+	t.Run("should truncate a torn tail record", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "wal")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		w, err := CreateWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to create wal: %s", err)
+		}
+		for _, k := range []string{"a", "b"} {
+			if err := w.Append(Record{Key: k}); err != nil {
+				t.Fatalf("failed to append record: %s", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close wal: %s", err)
+		}
+
+		// Chop a few bytes off the end of the last frame
+		p := fmtWALPath(d, 1)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("failed to stat wal: %s", err)
+		}
+		if err := os.Truncate(p, fi.Size()-3); err != nil {
+			t.Fatalf("failed to truncate wal: %s", err)
+		}
+
+		w, err = OpenWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to open wal: %s", err)
+		}
+		m, err := LoadMemtable(w, nil)
+		if err != nil {
+			t.Fatalf("failed to load memtable: %s", err)
+		}
+		if r, _ := m.Get("a"); r == nil {
+			t.Fatalf("expected key %q to be replayed", "a")
+		}
+		if r, _ := m.Get("b"); r != nil {
+			t.Fatalf("expected torn key %q to be dropped", "b")
+		}
+
+		// New writes should land after the last good frame
+		if err := m.Put(Record{Key: "c"}); err != nil {
+			t.Fatalf("failed to put record: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close wal: %s", err)
+		}
+
+		w, err = OpenWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to open wal: %s", err)
+		}
+		defer w.Close()
+		var keys []string
+		if err := w.Replay(func(r Record) error {
+			keys = append(keys, r.Key)
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to replay wal: %s", err)
+		}
+		if len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+			t.Fatalf("expected keys [a c], got %v", keys)
+		}
+	})
+
+	t.Run("should report a corrupt frame before the tail", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "wal")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		w, err := CreateWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to create wal: %s", err)
+		}
+		for _, k := range []string{"a", "b"} {
+			if err := w.Append(Record{Key: k}); err != nil {
+				t.Fatalf("failed to append record: %s", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close wal: %s", err)
+		}
+
+		// Flip a byte in the first frame's payload
+		p := fmtWALPath(d, 1)
+		before, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("failed to stat wal: %s", err)
+		}
+		flipTestByte(t, p, walHeaderSize+1)
+
+		w, err = OpenWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to open wal: %s", err)
+		}
+		defer w.Close()
+		err = w.Replay(func(r Record) error { return nil })
+		var ce *CorruptionError
+		if !errors.As(err, &ce) || !errors.Is(err, ErrCorruption) {
+			t.Fatalf("expected a corruption error, got %v", err)
+		}
+		if ce.File != path.Base(p) || ce.Offset != 0 {
+			t.Fatalf("expected corruption at offset 0, got %s", ce)
+		}
+
+		// ...and the frames after it should be left alone
+		after, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("failed to stat wal: %s", err)
+		}
+		if after.Size() != before.Size() {
+			t.Fatalf("expected the wal not to be truncated")
+		}
+	})
+
+	t.Run("should report a corrupt frame size instead of truncating", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "wal")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		w, err := CreateWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to create wal: %s", err)
+		}
+		var second int64
+		for i, k := range []string{"a", "b", "c", "d", "e"} {
+			if err := w.Append(Record{Key: k}); err != nil {
+				t.Fatalf("failed to append record: %s", err)
+			}
+			if i == 0 {
+				fi, err := w.file.Stat()
+				if err != nil {
+					t.Fatalf("failed to stat wal: %s", err)
+				}
+				second = fi.Size()
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close wal: %s", err)
+		}
+
+		// Make the second frame's size point past the end of the file
+		p := fmtWALPath(d, 1)
+		before, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("failed to stat wal: %s", err)
+		}
+		flipTestByte(t, p, second+6)
+
+		w, err = OpenWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to open wal: %s", err)
+		}
+		defer w.Close()
+		err = w.Replay(func(r Record) error { return nil })
+		var ce *CorruptionError
+		if !errors.As(err, &ce) || ce.Offset != second {
+			t.Fatalf("expected a corruption error at offset %d, got %v", second, err)
+		}
+		after, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("failed to stat wal: %s", err)
+		}
+		if after.Size() != before.Size() {
+			t.Fatalf("expected the wal not to be truncated")
+		}
+	})
+
+	t.Run("should truncate a zero-filled tail", func(t *testing.T) {
+		for _, n := range []int{walHeaderSize, 40} {
+			d, err := os.MkdirTemp("", "wal")
+			if err != nil {
+				t.Fatalf("failed to create tmp dir: %s", err)
+			}
+			defer os.RemoveAll(d)
+
+			w, err := CreateWAL(d, 1)
+			if err != nil {
+				t.Fatalf("failed to create wal: %s", err)
+			}
+			for _, k := range []string{"a", "b"} {
+				if err := w.Append(Record{Key: k}); err != nil {
+					t.Fatalf("failed to append record: %s", err)
+				}
+			}
+			fi, err := w.file.Stat()
+			if err != nil {
+				t.Fatalf("failed to stat wal: %s", err)
+			}
+
+			// Pad the file with zeros, like a crash that grew the
+			// file before the data made it to disk
+			if _, err := w.file.Write(make([]byte, n)); err != nil {
+				t.Fatalf("failed to write zeros: %s", err)
+			}
+
+			var keys []string
+			if err := w.Replay(func(r Record) error {
+				keys = append(keys, r.Key)
+				return nil
+			}); err != nil {
+				t.Fatalf("failed to replay wal with %d zero bytes: %s", n, err)
+			}
+			if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+				t.Fatalf("expected keys [a b], got %v", keys)
+			}
+			after, err := w.file.Stat()
+			if err != nil {
+				t.Fatalf("failed to stat wal: %s", err)
+			}
+			if after.Size() != fi.Size() {
+				t.Fatalf("expected the wal to be truncated to %d bytes, got %d", fi.Size(), after.Size())
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to close wal: %s", err)
+			}
+		}
+	})
+
+	t.Run("should refuse appends after a failed write can't be undone", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "wal")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		w, err := CreateWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to create wal: %s", err)
+		}
+		defer w.Close()
+		if err := w.Append(Record{Key: "a"}); err != nil {
+			t.Fatalf("failed to append record: %s", err)
+		}
+
+		// Swap in a read-only handle, so both the write and the
+		// truncate that would undo it fail
+		f := w.file
+		ro, err := os.Open(fmtWALPath(d, 1))
+		if err != nil {
+			t.Fatalf("failed to open wal: %s", err)
+		}
+		w.file = ro
+		if err := w.Append(Record{Key: "b"}); err == nil {
+			t.Fatalf("expected the append to fail")
+		}
+		w.file = f
+		ro.Close()
+
+		// The wal should stay failed, even though it's writable again
+		if err := w.Append(Record{Key: "c"}); err == nil {
+			t.Fatalf("expected appends to a failed wal to fail")
+		}
+		var keys []string
+		if err := w.Replay(func(r Record) error {
+			keys = append(keys, r.Key)
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to replay wal: %s", err)
+		}
+		if len(keys) != 1 || keys[0] != "a" {
+			t.Fatalf("expected keys [a], got %v", keys)
+		}
+	})
+
+	t.Run("should replay legacy JSON entries", func(t *testing.T) {
+		d, err := os.MkdirTemp("", "wal")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir: %s", err)
+		}
+		defer os.RemoveAll(d)
+
+		w, err := CreateWAL(d, 1)
+		if err != nil {
+			t.Fatalf("failed to create wal: %s", err)
+		}
+		defer w.Close()
+
+		// Write a record and a batch the way older versions did...
+		b, err := json.Marshal(Record{Key: "a", Seq: 1, Value: map[string]any{"n": 1}})
+		if err != nil {
+			t.Fatalf("failed to marshal record: %s", err)
+		}
+		if err := w.append(walEntryRecord, b); err != nil {
+			t.Fatalf("failed to append record: %s", err)
+		}
+		b, err = json.Marshal([]Record{{Key: "b", Seq: 2}, {Key: "c", Seq: 3, Tomb: true}})
+		if err != nil {
+			t.Fatalf("failed to marshal batch: %s", err)
+		}
+		if err := w.append(walEntryBatch, b); err != nil {
+			t.Fatalf("failed to append batch: %s", err)
+		}
+
+		// ...and a new one after them
+		if err := w.Append(Record{Key: "d", Seq: 4, Value: map[string]any{"n": 4}}); err != nil {
+			t.Fatalf("failed to append record: %s", err)
+		}
+
+		var got []Record
+		if err := w.Replay(func(r Record) error {
+			got = append(got, r)
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to replay wal: %s", err)
+		}
+		expected := []Record{
+			{Key: "a", Seq: 1, Value: map[string]any{"n": 1.0}},
+			{Key: "b", Seq: 2},
+			{Key: "c", Seq: 3, Tomb: true},
+			{Key: "d", Seq: 4, Value: map[string]any{"n": int64(4)}},
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, got)
+		}
+	})
+}